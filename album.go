@@ -0,0 +1,117 @@
+package main
+
+import (
+	"path"
+	"strconv"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// most_common returns the most frequent of values, preferring the first
+// seen on ties.
+func most_common(values []string) string {
+	counts := map[string]int{}
+	best := ""
+	for _, v := range values {
+		counts[v]++
+		if counts[v] > counts[best] {
+			best = v
+		}
+	}
+	return best
+}
+
+// va_name is the album artist given to compilations that have none, from
+// --va-name.
+var va_name = "Various Artists"
+
+// compilation_artist returns the album artist of an album's tracks. When
+// it's missing but every track is from the same album and they're by
+// different artists, it's --va-name, so a compilation is kept together
+// rather than split across the artists' directories.
+func compilation_artist(tracks []Metadata) string {
+	if len(tracks) == 0 {
+		return ""
+	}
+	first := tracks[0].Format.Tags
+	if first.AlbumArtist != "" || first.Album == "" {
+		return first.AlbumArtist
+	}
+	various := false
+	for _, m := range tracks[1:] {
+		tags := m.Format.Tags
+		if tags.AlbumArtist != "" || tags.Album != first.Album {
+			return ""
+		}
+		various = various || tags.Artist != first.Artist
+	}
+	if various {
+		return va_name
+	}
+	return ""
+}
+
+// check_album warns when the tracks of an album differ in sample rate,
+// codec or channels, which upsets gapless players, naming the outliers.
+// With --normalize-rate the jobs are resampled to a single rate, the most
+// common one for "auto".
+func check_album(ctx *cli.Context, jobs []job) []job {
+	metadata := probe_all(jobs)
+	properties := []struct {
+		name  string
+		value func(*Stream) string
+	}{
+		{"sample rate", func(s *Stream) string { return s.SampleRate }},
+		{"codec", func(s *Stream) string { return s.CodecName }},
+		{"channels", func(s *Stream) string { return strconv.Itoa(s.Channels) }},
+	}
+	rates := make([]string, len(jobs))
+	for _, property := range properties {
+		values := make([]string, len(jobs))
+		for i, m := range metadata {
+			if stream := audio_stream(m); stream != nil {
+				values[i] = property.value(stream)
+			}
+		}
+		if property.name == "sample rate" {
+			copy(rates, values)
+		}
+		common := most_common(values)
+		var outliers []string
+		for i, v := range values {
+			if v != common && v != "" {
+				outliers = append(outliers, path.Base(jobs[i].input)+"="+v)
+			}
+		}
+		if len(outliers) > 0 {
+			log.Warn("Album tracks are inconsistent", "property", property.name, "usual", common, "outliers", outliers)
+		}
+	}
+
+	normalize := ctx.String("normalize-rate")
+	if normalize == "" {
+		return jobs
+	}
+	if normalize == "auto" {
+		normalize = most_common(rates)
+	}
+	rate, err := strconv.Atoi(normalize)
+	if err != nil || rate <= 0 {
+		return jobs
+	}
+	jobs = append([]job(nil), jobs...)
+	for i := range jobs {
+		if rates[i] != normalize {
+			jobs[i].sample_rate = rate
+		}
+	}
+	return jobs
+}
+
+// valid_normalize_rate reports whether --normalize-rate is "auto" or a
+// sample rate.
+func valid_normalize_rate(s string) bool {
+	rate, err := strconv.Atoi(s)
+	return s == "" || s == "auto" || (err == nil && rate > 0)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// album_snapshot returns the modification times of the files and
+// directories under an album's outputdir, taken before anything is written
+// for the album so album_files can tell what it added. It's only taken
+// for --output-archive, --dir-mode and --file-mode, which need it.
+func album_snapshot(ctx *cli.Context, outputdir string) (map[string]time.Time, error) {
+	if !ctx.Bool("output-archive") && ctx.String("dir-mode") == "" && ctx.String("file-mode") == "" {
+		return nil, nil
+	}
+	files := map[string]time.Time{}
+	err := filepath.WalkDir(outputdir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[path] = info.ModTime()
+		return nil
+	})
+	return files, err
+}
+
+// album_files returns the files of an album converted into outputdir: its
+// outputs, and the extras such as artwork, sidecars and playlists that were
+// written since the album_snapshot before. Anything else there, such as an
+// existing library in --output-dir, other albums' outputs and zips, and
+// partial outputs, is left out.
+func album_files(outputdir string, outputs []conversion_result, before map[string]time.Time) ([]string, error) {
+	var files []string
+	for _, o := range outputs {
+		files = append(files, o.output)
+	}
+	err := filepath.WalkDir(outputdir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		base := filepath.Base(path)
+		if isMediaFile(path) || strings.EqualFold(filepath.Ext(path), ".zip") || strings.HasPrefix(base, ".") && strings.Contains(base, ".partial") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if modified, ok := before[path]; !ok || !info.ModTime().Equal(modified) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return slices.Compact(files), nil
+}
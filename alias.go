@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// warned_aliases records the aliases already noted, as the transcoder is
+// looked up many times a run.
+var warned_aliases sync.Map
+
+// resolve_preset_alias maps a preset name through the --preset-alias
+// old=new pairs, noting when an alias is used so scripts can be updated.
+func resolve_preset_alias(ctx *cli.Context, name string) string {
+	for _, alias := range ctx.StringSlice("preset-alias") {
+		old, preset, ok := strings.Cut(alias, "=")
+		if !ok || strings.TrimSpace(preset) == "" {
+			log.Fatal("Invalid preset alias, expected old=new", "alias", alias)
+		}
+		if strings.TrimSpace(old) == name {
+			if _, warned := warned_aliases.LoadOrStore(name, true); !warned {
+				log.Warn("Preset alias is deprecated, use the preset name instead", "alias", name, "preset", strings.TrimSpace(preset))
+			}
+			return strings.TrimSpace(preset)
+		}
+	}
+	return name
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// archive_time is the modification time of every zip entry, so archiving
+// the same outputs always gives the same zip.
+var archive_time = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// archive_name returns "Artist - Album.zip" for an album.
+func archive_name(tags Tags) string {
+	if tags.Album == "" {
+		return "album.zip"
+	}
+	if tags.AlbumArtist == "" {
+		return normalize_name(filesafe(tags.Album) + ".zip")
+	}
+	return normalize_name(filesafe(join_artists(tags.AlbumArtist)) + " - " + filesafe(tags.Album) + ".zip")
+}
+
+// write_archive zips an album's files, from album_files, into a file of
+// that name in outputdir, at the --archive-compression deflate level.
+// Entries are in lexical order with fixed times, so the zip is
+// reproducible. With --archive-clean the archived files are removed,
+// leaving just the zip.
+func write_archive(ctx *cli.Context, outputdir string, name string, files []string) (string, error) {
+	filename := filepath.Join(outputdir, name)
+	files = slices.DeleteFunc(slices.Clone(files), func(path string) bool { return path == filename })
+	slices.Sort(files)
+
+	log.Info("🗜 Archiving", "name", name, "files", len(files))
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	level := ctx.Int("archive-compression")
+	w := zip.NewWriter(f)
+	w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	for _, path := range files {
+		rel, err := filepath.Rel(outputdir, path)
+		if err != nil {
+			return "", err
+		}
+		header := &zip.FileHeader{Name: filepath.ToSlash(rel), Method: zip.Deflate, Modified: archive_time}
+		if level == 0 {
+			header.Method = zip.Store
+		}
+		if err := archive_file(w, header, path); err != nil {
+			return "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	if ctx.Bool("archive-clean") {
+		for _, path := range files {
+			if err := os.Remove(path); err != nil {
+				return "", err
+			}
+			// and the directories emptied, such as per disc or track ones
+			dir := filepath.Dir(path)
+			for dir != filepath.Clean(outputdir) && os.Remove(dir) == nil {
+				dir = filepath.Dir(dir)
+			}
+		}
+	}
+	return filename, nil
+}
+
+func archive_file(w *zip.Writer, header *zip.FileHeader, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(out, in, make([]byte, copy_buffer_size))
+	return err
+}
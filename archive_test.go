@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func zip_entries(t *testing.T, filename string) []string {
+	t.Helper()
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestArchiveSharedOutputDir(t *testing.T) {
+	fake_tools(t)
+	dir := t.TempDir()
+	library := filepath.Join(dir, "library")
+	if err := os.MkdirAll(library, 0777); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(library, "notes.txt")
+	if err := os.WriteFile(existing, []byte("already here"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, input := range []string{"First/a.flac", "Second/b.flac"} {
+		input = filepath.Join(dir, input)
+		if err := os.MkdirAll(filepath.Dir(input), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(input, []byte("fLaC"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, input)
+	}
+
+	var err error
+	run_app(t, []string{"--transcoder-preset", "opus", "--output-dir", library, "--output-archive", "--playlist", "m3u8", "--skip-artwork", "--progress", "never"}, func(ctx *cli.Context) {
+		err = process_single_files(ctx, files)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := zip_entries(t, filepath.Join(library, "First.zip")), []string{"01 - a.opus", "First.m3u8"}; !slices.Equal(got, want) {
+		t.Errorf("First.zip = %q, want %q", got, want)
+	}
+	if got, want := zip_entries(t, filepath.Join(library, "Second.zip")), []string{"01 - b.opus", "Second.m3u8"}; !slices.Equal(got, want) {
+		t.Errorf("Second.zip = %q, want %q", got, want)
+	}
+	if data, err := os.ReadFile(existing); err != nil || string(data) != "already here" {
+		t.Errorf("existing file = %q, %v", data, err)
+	}
+}
+
+func TestArchiveClean(t *testing.T) {
+	outputdir := t.TempDir()
+	var files []string
+	for _, name := range []string{"Disc 1/01 - a.opus", "Disc 2/01 - b.opus", "cover.jpg"} {
+		filename := filepath.Join(outputdir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, filename)
+	}
+	other := filepath.Join(outputdir, "Disc 2", "notes.txt")
+	if err := os.WriteFile(other, []byte("not archived"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var filename string
+	var err error
+	run_app(t, []string{"--archive-clean"}, func(ctx *cli.Context) {
+		filename, err = write_archive(ctx, outputdir, "Album.zip", files)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := zip_entries(t, filename), []string{"Disc 1/01 - a.opus", "Disc 2/01 - b.opus", "cover.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("Album.zip = %q, want %q", got, want)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outputdir, "Disc 1")); !os.IsNotExist(err) {
+		t.Errorf("emptied directory wasn't removed: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("unarchived file was removed: %v", err)
+	}
+}
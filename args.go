@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// split_args splits a command line into arguments like a shell, on
+// whitespace outside of single or double quotes, with backslash escaping
+// the next character outside single quotes. Nothing is expanded.
+func split_args(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	in_arg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, in_arg = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, in_arg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if in_arg {
+				args = append(args, arg.String())
+				arg.Reset()
+				in_arg = false
+			}
+		default:
+			arg.WriteRune(r)
+			in_arg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if in_arg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
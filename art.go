@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// image_size returns the dimensions of an image, or zeros if it can't be
+// decoded.
+func image_size(filename string) (int, int) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// primary_image picks the album cover from a set of images: the one with
+// the longest short side, which favours large and square images over
+// booklet scans and banners. Ties go to the larger area.
+func primary_image(images []string) string {
+	best, best_side, best_area := "", -1, -1
+	for _, filename := range images {
+		w, h := image_size(filename)
+		side, area := min(w, h), w*h
+		if side > best_side || (side == best_side && area > best_area) {
+			best, best_side, best_area = filename, side, area
+		}
+	}
+	return best
+}
+
+// art_name returns the --art-name filename for a primary image, keeping the
+// image's own extension if it differs, e.g. cover.png.
+func art_name(ctx *cli.Context, filename string) string {
+	name := ctx.String("art-name")
+	ext := filepath.Ext(filename)
+	if !strings.EqualFold(filepath.Ext(name), ext) && !(is_jpeg(ext) && is_jpeg(filepath.Ext(name))) {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + strings.ToLower(ext)
+	}
+	return normalize_name(name)
+}
+
+func is_jpeg(ext string) bool {
+	return strings.EqualFold(ext, ".jpg") || strings.EqualFold(ext, ".jpeg")
+}
+
+// art_sources are the --art-source preferences for the album cover.
+var art_sources = []string{"file", "embedded", "largest"}
+
+// embedded_cover returns the picture embedded in track when it should be
+// the album cover rather than the primary image, by --art-source: file
+// prefers the image, embedded the picture, and largest whichever has the
+// longer short side. Either is used when it's the only one.
+func embedded_cover(ctx *cli.Context, track string, primary string) (int, *Stream) {
+	source := ctx.String("art-source")
+	if track == "" || (source == "file" && primary != "") {
+		return -1, nil
+	}
+	metadata, err := get_metadata(track)
+	if err != nil {
+		return -1, nil
+	}
+	index, stream := picture_stream(metadata)
+	if stream == nil || picture_extensions[stream.CodecName] == "" {
+		return -1, nil
+	}
+	if source == "largest" && primary != "" {
+		w, h := image_size(primary)
+		if min(stream.Width, stream.Height) <= min(w, h) {
+			return -1, nil
+		}
+	}
+	return index, stream
+}
+
+// copy_artwork copies the album images into dir, with the primary image
+// renamed to --art-name. When --art-source picks the picture embedded in
+// the album's first track instead, it's extracted as --art-name and the
+// images keep their own names. Up to --copy-jobs images are copied at
+// once, as albums with scanned booklets can have many.
+func copy_artwork(ctx *cli.Context, images []string, track string, dir string) error {
+	primary := primary_image(images)
+	cover := ""
+	if index, stream := embedded_cover(ctx, track, primary); stream != nil {
+		name := art_name(ctx, "cover"+picture_extensions[stream.CodecName])
+		if err := extract_picture(ctx.Context, track, index, filepath.Join(dir, name)); err != nil {
+			log.Warn("Failed to extract embedded artwork", "name", filepath.Base(track), "error", err)
+		} else {
+			log.Info("🖼 Extracted embedded artwork", "name", name)
+			primary, cover = "", name
+		}
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	slots := make(chan struct{}, max(1, ctx.Int("copy-jobs")))
+	for _, filename := range images {
+		name := normalize_name(filepath.Base(filename))
+		if filename == primary {
+			name = art_name(ctx, filename)
+		} else if ctx.Bool("drop-secondary-art") || name == cover {
+			// an image named like the cover would replace the extracted one
+			continue
+		}
+		log.Info("🎨 Copying artwork", "file", filepath.Base(filename), "as", name)
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(src, dst string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := copy_file(src, dst); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(filename, filepath.Join(dir, name))
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// copy_track_art copies the album images in dir into a --per-track-dir
+// track directory, as DJ software looks for the cover beside each track.
+func copy_track_art(dir string, trackdir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isImageFile(entry.Name()) {
+			continue
+		}
+		if err := copy_file(filepath.Join(dir, entry.Name()), filepath.Join(trackdir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// artwork_only handles an album's artwork without converting its tracks,
+// for --artwork-only: images are copied or fetched into outputdir as usual
+// and uploaded to the album's destinations.
+func artwork_only(ctx *cli.Context, jobs []job, outputdir string, before map[string]time.Time, dests []string, tags Tags) error {
+	for _, j := range jobs {
+		if !is_ogg(j.input) && !ctx.Bool("per-track-dir") {
+			continue
+		}
+		t := job_transcoder(ctx, get_transcoder(ctx), j)
+		metadata, err := job_metadata(t, j)
+		if err != nil {
+			return err
+		}
+		if is_ogg(j.input) {
+			extract_ogg_art(ctx.Context, ctx, j.input, metadata, j.outputdir)
+		}
+		if ctx.Bool("per-track-dir") {
+			output, err := output_path(ctx, t, j, metadata)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(output), 0777); err != nil {
+				return err
+			}
+			if err := copy_track_art(j.outputdir, filepath.Dir(output)); err != nil {
+				return err
+			}
+			save_track_art(ctx.Context, ctx, j.input, metadata, output)
+		}
+	}
+	if url_template := ctx.String("art-from-url"); url_template != "" {
+		fetch_missing_art(ctx, url_template, outputdir, tags)
+	}
+	if !has_artwork(outputdir) {
+		log.Warn("No artwork found", "album", tags.Album)
+		return nil
+	}
+	if before != nil {
+		files, err := album_files(outputdir, nil, before)
+		if err != nil {
+			return err
+		}
+		if err := apply_modes(ctx, outputdir, files, before); err != nil {
+			log.Error("Failed to set permissions", "error", err)
+		}
+	}
+	if len(dests) == 0 {
+		log.Info("Output files:", "path", outputdir)
+		return nil
+	}
+	if err := rsync_all(ctx, outputdir+"/", dests); err != nil {
+		return err
+	}
+	cleanupTmpdir(outputdir, "output directory")
+	return nil
+}
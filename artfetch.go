@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+var art_client = &http.Client{Timeout: 15 * time.Second}
+
+// fetched_art caches downloaded artwork by album, so each album is only
+// requested once. A nil entry records a failed request.
+var fetched_art = map[string]*fetched_image{}
+var fetched_art_mu sync.Mutex
+
+type fetched_image struct {
+	data      []byte
+	extension string
+}
+
+// has_artwork reports whether there are any images under dir.
+func has_artwork(dir string) bool {
+	found := false
+	filepath.WalkDir(dir, func(filename string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && isImageFile(filename) {
+			found = true
+			return filepath.SkipAll
+		}
+		return err
+	})
+	return found
+}
+
+// fetch_art downloads artwork from the --art-from-url template. The Artist
+// and Album fields are URL escaped.
+func fetch_art(url_template string, tags Tags) (*fetched_image, error) {
+	fetched_art_mu.Lock()
+	defer fetched_art_mu.Unlock()
+	key := tags.AlbumArtist + "\x00" + tags.Album
+	if image, ok := fetched_art[key]; ok {
+		return image, nil
+	}
+	fetched_art[key] = nil
+
+	tmpl, err := template.New("art").Parse(url_template)
+	if err != nil {
+		return nil, err
+	}
+	var u bytes.Buffer
+	err = tmpl.Execute(&u, map[string]string{
+		"Artist": url.QueryEscape(tags.AlbumArtist),
+		"Album":  url.QueryEscape(tags.Album),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("🌐 Fetching artwork", "url", u.String())
+	resp, err := art_client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		log.Warn("No artwork found", "album", tags.Album)
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching artwork: %s", resp.Status)
+	}
+	var extension string
+	switch content := resp.Header.Get("Content-Type"); {
+	case strings.HasPrefix(content, "image/jpeg"):
+		extension = "jpg"
+	case strings.HasPrefix(content, "image/png"):
+		extension = "png"
+	default:
+		return nil, fmt.Errorf("fetching artwork: unexpected content type %s", content)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	image := &fetched_image{data, extension}
+	fetched_art[key] = image
+	return image, nil
+}
+
+// fetch_missing_art saves fetched artwork to outputdir when the album has
+// none of its own.
+func fetch_missing_art(ctx *cli.Context, url_template string, outputdir string, tags Tags) {
+	if has_artwork(outputdir) {
+		return
+	}
+	image, err := fetch_art(url_template, tags)
+	if err != nil {
+		log.Warn("Failed to fetch artwork", "error", err)
+		return
+	}
+	if image == nil {
+		return
+	}
+	dest := filepath.Join(outputdir, art_name(ctx, "cover."+image.extension))
+	if err := os.WriteFile(dest, image.data, 0666); err != nil {
+		log.Warn("Failed to save artwork", "error", err)
+	}
+}
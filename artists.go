@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+)
+
+// artist_separator joins the values of multi-artist tags in paths and
+// playlists, from --artist-separator. Empty keeps tags as they're written.
+// Output tags aren't split, as ffmpeg writes them as one value.
+var artist_separator string
+
+// split_artists returns the values of a multi-value artist tag. ffprobe
+// joins repeated tags, such as several Vorbis ARTIST fields, with ";",
+// which is also how they're commonly written in a single tag.
+func split_artists(value string) []string {
+	var artists []string
+	for _, v := range strings.Split(value, ";") {
+		if v = strings.TrimSpace(v); v != "" && !contains_fold(artists, v) {
+			artists = append(artists, v)
+		}
+	}
+	return artists
+}
+
+func contains_fold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// join_artists returns an artist tag joined with --artist-separator.
+func join_artists(value string) string {
+	if artist_separator == "" {
+		return value
+	}
+	return strings.Join(split_artists(value), artist_separator)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitArtists(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"Björk", []string{"Björk"}},
+		{"Simon;Garfunkel", []string{"Simon", "Garfunkel"}},
+		{" Daft Punk ; Pharrell Williams ;Nile Rodgers", []string{"Daft Punk", "Pharrell Williams", "Nile Rodgers"}},
+		{"Queen;;queen;David Bowie", []string{"Queen", "David Bowie"}},
+		{"Crosby, Stills, Nash & Young", []string{"Crosby, Stills, Nash & Young"}},
+	}
+	for _, tt := range tests {
+		if got := split_artists(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("split_artists(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJoinArtists(t *testing.T) {
+	defer func(separator string) { artist_separator = separator }(artist_separator)
+	artist_separator = ""
+	if got := join_artists("Simon;Garfunkel"); got != "Simon;Garfunkel" {
+		t.Errorf("join_artists without a separator = %q, want the tag unchanged", got)
+	}
+	artist_separator = " & "
+	tests := []struct{ in, want string }{
+		{"Simon;Garfunkel", "Simon & Garfunkel"},
+		{"Queen; David Bowie;queen", "Queen & David Bowie"},
+		{"Björk", "Björk"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := join_artists(tt.in); got != tt.want {
+			t.Errorf("join_artists(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+var benchmark_command = &cli.Command{
+	Name:      "benchmark",
+	Usage:     "convert a sample file with each preset and compare the results",
+	ArgsUsage: "FILE",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "presets",
+			Usage: "presets to compare (default all)",
+		},
+	},
+	Action: benchmark,
+}
+
+func benchmark(ctx *cli.Context) error {
+	log.SetTimeFormat(time.Kitchen)
+	set_log_level(ctx.String("log-level"))
+	if ctx.NArg() != 1 {
+		log.Fatal("Benchmark needs a single input file")
+	}
+	input := ctx.Args().First()
+	metadata, err := get_metadata(input)
+	if err != nil {
+		return err
+	}
+	source, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+
+	presets := ctx.StringSlice("presets")
+	if len(presets) == 0 {
+		for name := range transcoder_presets {
+			presets = append(presets, name)
+		}
+		slices.Sort(presets)
+	}
+
+	tmpdir, err := os.MkdirTemp("", "audioconvert")
+	if err != nil {
+		return err
+	}
+	defer cleanupTmpdir(tmpdir, "temporary directory")
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "preset\tsize\ttime\tratio\t")
+	for _, name := range presets {
+		t := preset_transcoder(ctx, name)
+		output := filepath.Join(tmpdir, name+"."+t.extension)
+		log.Info("⏱ Benchmarking", "preset", name)
+		start := time.Now()
+		err := convert(ctx.Context, transcoder_command(ctx, t, job{input: input}, metadata), input, output, metadata, func(float64) {})
+		elapsed := time.Since(start)
+		if err != nil {
+			log.Error("Benchmark failed", "preset", name, "error", err)
+			continue
+		}
+		stat, err := os.Stat(output)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(table, "%s\t%d\t%.2fs\t%.2f\t\n", name, stat.Size(), elapsed.Seconds(), float64(source.Size())/float64(stat.Size()))
+	}
+	return table.Flush()
+}
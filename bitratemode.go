@@ -0,0 +1,98 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// bitrate_modes are the --bitrate-mode rate controls. The default leaves
+// each preset's own.
+var bitrate_modes = []string{"", "vbr", "cbr", "abr"}
+
+var opus_bitrate_modes = map[string]string{"vbr": "on", "cbr": "off", "abr": "constrained"}
+
+// cbr_bitrates are the standard constant bitrates, in kbps.
+var cbr_bitrates = []int{96, 112, 128, 160, 192, 224, 256, 320}
+
+// warned_bitrate_modes records the codecs already warned about, so the
+// warning is given once rather than for every file.
+var warned_bitrate_modes sync.Map
+
+// remove_arg returns a copy of args without option and its value.
+func remove_arg(args []string, option string) []string {
+	args = slices.Clone(args)
+	if i := slices.Index(args, option); i >= 0 && i+1 < len(args) {
+		return slices.Delete(args, i, i+2)
+	}
+	return args
+}
+
+// nearest_cbr returns the standard constant bitrate closest to an average.
+func nearest_cbr(bitrate float64) string {
+	best := cbr_bitrates[0]
+	for _, kbps := range cbr_bitrates {
+		if abs(float64(kbps)*1000-bitrate) < abs(float64(best)*1000-bitrate) {
+			best = kbps
+		}
+	}
+	return strconv.Itoa(best) + "k"
+}
+
+func abs(x float64) float64 {
+	return max(x, -x)
+}
+
+// quality_bitrate returns the bitrate of a quality based preset, to switch
+// it to a fixed bitrate.
+func quality_bitrate(codec string, args []string) string {
+	if i := slices.Index(args, "-q:a"); i >= 0 && i+1 < len(args) {
+		if bitrate, ok := vbr_bitrates[codec][args[i+1]]; ok {
+			return nearest_cbr(bitrate)
+		}
+	}
+	return nearest_cbr(default_bitrate)
+}
+
+// bitrate_mode_args applies --bitrate-mode to the encoder options of a
+// codec. Modes the codec's encoder doesn't have leave the options unchanged
+// with a warning.
+func bitrate_mode_args(ctx *cli.Context, codec string, args []string) []string {
+	mode := ctx.String("bitrate-mode")
+	if mode == "" {
+		return args
+	}
+	switch {
+	case codec == "libopus":
+		return set_arg(args, "-vbr", opus_bitrate_modes[mode])
+	case codec == "libmp3lame" || codec == "libvorbis":
+		if mode == "vbr" {
+			if slices.Contains(args, "-q:a") {
+				return args
+			}
+			break
+		}
+		if !slices.Contains(args, "-b:a") {
+			bitrate := quality_bitrate(codec, args)
+			args = set_arg(remove_arg(args, "-q:a"), "-b:a", bitrate)
+		}
+		if mode == "abr" && codec == "libmp3lame" {
+			return append(args, "-abr", "1")
+		}
+		if mode == "cbr" && codec == "libvorbis" {
+			i := slices.Index(args, "-b:a")
+			return append(args, "-minrate", args[i+1], "-maxrate", args[i+1])
+		}
+		return args
+	case codec == "aac" && mode == "abr":
+		// the native encoder's rate control is an average bitrate
+		return args
+	}
+	if _, warned := warned_bitrate_modes.LoadOrStore(codec, true); !warned {
+		log.Warn("Bitrate mode isn't supported by the codec, using the preset's", "mode", mode, "codec", codec)
+	}
+	return args
+}
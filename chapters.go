@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Chapter is a chapter from ffprobe -show_chapters.
+type Chapter struct {
+	StartTime string `json:"start_time"`
+	Tags      struct {
+		Title string `json:"title"`
+	} `json:"tags"`
+}
+
+type chapter struct {
+	start float64
+	title string
+}
+
+// file_chapters are the chapters loaded from --chapters-file, used in
+// place of those in the source.
+var file_chapters []chapter
+
+// parse_chapter_time parses [[hh:]mm:]ss[.mmm] into seconds.
+func parse_chapter_time(s string) (float64, error) {
+	seconds := 0.0
+	for _, part := range strings.Split(s, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// load_chapters_file reads a file of "hh:mm:ss.mmm Title" lines, as
+// published with podcasts and videos. Blank lines are ignored.
+func load_chapters_file(filename string) ([]chapter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var chapters []chapter
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		timestamp, title, _ := strings.Cut(line, " ")
+		start, err := parse_chapter_time(timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, n, err)
+		}
+		chapters = append(chapters, chapter{start, strings.TrimSpace(title)})
+	}
+	return chapters, scanner.Err()
+}
+
+// source_chapters returns the chapters for a track: those from
+// --chapters-file, otherwise the source's own.
+func source_chapters(metadata Metadata) []chapter {
+	if file_chapters != nil {
+		return file_chapters
+	}
+	var chapters []chapter
+	for _, c := range metadata.Chapters {
+		start, err := strconv.ParseFloat(c.StartTime, 64)
+		if err != nil {
+			continue
+		}
+		chapters = append(chapters, chapter{start, c.Tags.Title})
+	}
+	return chapters
+}
+
+func chapter_timestamp(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// chapter_args writes the chapters as the CHAPTERxxx and CHAPTERxxxNAME
+// comments podcast apps read from Ogg files. ffmpeg's own chapters are
+// dropped so they aren't written twice.
+func chapter_args(chapters []chapter) []string {
+	if len(chapters) == 0 {
+		return nil
+	}
+	args := []string{"-map_chapters", "-1"}
+	for i, c := range chapters {
+		key := fmt.Sprintf("CHAPTER%03d", i+1)
+		args = append(args, "-metadata", key+"="+chapter_timestamp(c.start))
+		if c.title != "" {
+			args = append(args, "-metadata", key+"NAME="+c.title)
+		}
+	}
+	return args
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// clipping_headroom is the peak level in dBFS sources are reduced to with
+// --prevent-clipping. Lossy encoders overshoot the source peaks, so
+// masters peaking above this clip once decoded.
+const clipping_headroom = -1.0
+
+var peak_level_re = regexp.MustCompile(`Peak level dB: (-?[0-9.]+)`)
+
+// peak_level decodes a file through astats, returning its overall sample
+// peak in dBFS.
+func peak_level(runctx context.Context, filename string) (float64, error) {
+	ffmpeg := exec.CommandContext(runctx, "ffmpeg", "-nostdin", "-hide_banner", "-i", filename, "-map", "0:a:0",
+		"-af", "astats=measure_perchannel=none:measure_overall=Peak_level", "-f", "null", "-")
+	out, err := ffmpeg.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("peak detection failed: %w", err)
+	}
+	m := peak_level_re.FindSubmatch(out)
+	if m == nil {
+		// silence reports -inf
+		return clipping_headroom - 1, nil
+	}
+	return strconv.ParseFloat(string(m[1]), 64)
+}
+
+// clipping_gain returns the further gain in dB bringing a source's peak,
+// after the gain already applied, down to clipping_headroom, or 0 if it
+// already has enough headroom.
+func clipping_gain(runctx context.Context, filename string, applied float64) (float64, error) {
+	peak, err := peak_level(runctx, filename)
+	if err != nil {
+		return 0, err
+	}
+	return min(0, clipping_headroom-peak-applied), nil
+}
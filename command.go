@@ -0,0 +1,69 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// command_line is a conversion command. Presets, and custom commands
+// without --shell, run without a shell: placeholders are substituted with
+// the paths and tags literally, so neither filenames nor tags can inject
+// anything. Shell commands read them from the environment instead.
+type command_line struct {
+	args   []string
+	shell  bool
+	custom bool
+}
+
+// command_var matches the placeholders in custom commands, $name or
+// ${name}.
+var command_var = regexp.MustCompile(`\$(\w+)|\$\{(\w+)\}`)
+
+// custom_command returns the command line for a --transcoder-command,
+// which has already been validated.
+func custom_command(t transcoder) command_line {
+	if t.shell {
+		return command_line{args: []string{"bash", "-c", t.command}, shell: true, custom: true}
+	}
+	args, _ := split_args(t.command)
+	return command_line{args: args, custom: true}
+}
+
+// resolve returns the arguments to run with for the placeholders of a
+// track. Preset arguments are substituted only when they are exactly
+// $input or $output, as everything else in them comes from tags and
+// flags. Custom commands have every track placeholder substituted in a
+// single pass, so values containing placeholders are left as they are.
+// Unknown names are passed through.
+func (c command_line) resolve(vars map[string]string) []string {
+	if c.shell {
+		return c.args
+	}
+	args := slices.Clone(c.args)
+	for i, arg := range args {
+		if !c.custom {
+			switch arg {
+			case "$input":
+				args[i] = vars["input"]
+			case "$output":
+				args[i] = vars["output"]
+			}
+			continue
+		}
+		args[i] = command_var.ReplaceAllStringFunc(arg, func(m string) string {
+			if value, ok := vars[strings.Trim(m, "${}")]; ok {
+				return value
+			}
+			return m
+		})
+	}
+	return args
+}
+
+func (c command_line) String() string {
+	if c.shell {
+		return c.args[2]
+	}
+	return shell_join(c.args)
+}
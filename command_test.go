@@ -0,0 +1,39 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolvePreset(t *testing.T) {
+	input := "/music/My $output $(touch pwned) song.flac"
+	output := "/out/My ${input} song.opus"
+	c := command_line{args: []string{"ffmpeg", "-i", "$input", "-metadata", "title=$input $output", "$output"}}
+	got := c.resolve(track_vars(input, output, Metadata{}))
+	want := []string{"ffmpeg", "-i", input, "-metadata", "title=$input $output", output}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolve = %q, want %q", got, want)
+	}
+}
+
+func TestResolveCustom(t *testing.T) {
+	var metadata Metadata
+	metadata.Format.Tags = Tags{Artist: "AC/DC $title", AlbumArtist: "Various", Album: "Back in $(Black)", Title: "Hells Bells", Track: "1"}
+	input := "/music/My $output $(touch pwned) song.flac"
+	output := "/out/My ${input} song.opus"
+	c := custom_command(transcoder{command: `enc --artist "$artist" --aa=${album_artist} --album "$album" -t "$title" -n $track "$input" -o "$output" $HOME`})
+	got := c.resolve(track_vars(input, output, metadata))
+	want := []string{"enc", "--artist", "AC/DC $title", "--aa=Various", "--album", "Back in $(Black)", "-t", "Hells Bells", "-n", "1", input, "-o", output, "$HOME"}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolve = %q, want %q", got, want)
+	}
+}
+
+func TestResolveShell(t *testing.T) {
+	c := custom_command(transcoder{command: `sox "$input" "$output"`, shell: true})
+	got := c.resolve(track_vars("in $output.flac", "out.flac", Metadata{}))
+	want := []string{"bash", "-c", `sox "$input" "$output"`}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolve = %q, want %q", got, want)
+	}
+}
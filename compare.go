@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+var compare_command = &cli.Command{
+	Name:      "compare",
+	Usage:     "convert a file with two presets and compare their size and quality",
+	ArgsUsage: "FILE PRESET PRESET",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "quality",
+			Usage: "score each output by its signal to distortion ratio against the source",
+		},
+	},
+	Action: compare,
+}
+
+// comparison is the result of converting with one preset.
+type comparison struct {
+	preset string
+	size   int64
+	sdr    float64
+}
+
+var sdr_re = regexp.MustCompile(`SDR ch\d+: (-?[0-9.]+|inf) dB`)
+
+// signal_distortion returns the signal to distortion ratio of an output
+// against its source, averaged over the channels. Both are resampled to
+// 48kHz stereo first, as that's what opus decodes to.
+func signal_distortion(runctx context.Context, source, output string) (float64, error) {
+	format := "aresample=48000,aformat=sample_fmts=fltp:channel_layouts=stereo"
+	ffmpeg := exec.CommandContext(runctx, "ffmpeg", "-nostdin", "-hide_banner", "-i", source, "-i", output,
+		"-filter_complex", "[0:a]"+format+"[a];[1:a]"+format+"[b];[a][b]asdr", "-f", "null", "-")
+	out, err := ffmpeg.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("quality scoring failed: %w", err)
+	}
+	matches := sdr_re.FindAllSubmatch(out, -1)
+	if matches == nil {
+		return 0, fmt.Errorf("quality scoring failed: no SDR reported")
+	}
+	total := 0.0
+	for _, m := range matches {
+		sdr, err := strconv.ParseFloat(string(m[1]), 64)
+		if err != nil {
+			return 0, err
+		}
+		total += sdr
+	}
+	return total / float64(len(matches)), nil
+}
+
+func compare(ctx *cli.Context) error {
+	log.SetTimeFormat(time.Kitchen)
+	set_log_level(ctx.String("log-level"))
+	if ctx.NArg() != 3 {
+		log.Fatal("Compare needs an input file and two presets")
+	}
+	input := ctx.Args().Get(0)
+	metadata, err := get_metadata(input)
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := os.MkdirTemp("", "audioconvert")
+	if err != nil {
+		return err
+	}
+	defer cleanupTmpdir(tmpdir, "temporary directory")
+
+	var results []comparison
+	for i, name := range ctx.Args().Slice()[1:] {
+		t := preset_transcoder(ctx, name)
+		output := filepath.Join(tmpdir, fmt.Sprintf("%d.%s", i, t.extension))
+		log.Info("⚖️ Comparing", "preset", name)
+		if err := convert(ctx.Context, transcoder_command(ctx, t, job{input: input}, metadata), input, output, metadata, func(float64) {}); err != nil {
+			return err
+		}
+		stat, err := os.Stat(output)
+		if err != nil {
+			return err
+		}
+		result := comparison{preset: name, size: stat.Size()}
+		if ctx.Bool("quality") {
+			if result.sdr, err = signal_distortion(ctx.Context, input, output); err != nil {
+				return err
+			}
+		}
+		results = append(results, result)
+	}
+
+	a, b := results[0], results[1]
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if ctx.Bool("quality") {
+		fmt.Fprintln(table, "preset\tsize\tsdr\t")
+		for _, r := range results {
+			fmt.Fprintf(table, "%s\t%d\t%.1fdB\t\n", r.preset, r.size, r.sdr)
+		}
+	} else {
+		fmt.Fprintln(table, "preset\tsize\t")
+		for _, r := range results {
+			fmt.Fprintf(table, "%s\t%d\t\n", r.preset, r.size)
+		}
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	smaller, larger := a, b
+	if b.size < a.size {
+		smaller, larger = b, a
+	}
+	verdict := fmt.Sprintf("%s is %.0f%% smaller than %s", smaller.preset, 100*(1-float64(smaller.size)/float64(larger.size)), larger.preset)
+	if ctx.Bool("quality") {
+		if smaller.sdr >= larger.sdr {
+			verdict += ", with no loss in quality"
+		} else {
+			verdict += fmt.Sprintf(", at %.1fdB lower SDR", larger.sdr-smaller.sdr)
+		}
+	}
+	fmt.Println(verdict)
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// conflict_policies are the --on-conflict ways of handling outputs that
+// already exist, locally or at the rsync destination.
+var conflict_policies = []string{"overwrite", "skip", "version"}
+
+// rsync_exists reports whether a directory exists at an rsync destination,
+// which may be remote.
+func rsync_exists(dest string) bool {
+	return exec.Command("rsync", "--list-only", dest+"/").Run() == nil
+}
+
+// conflict_dest returns where an album is uploaded to. With
+// --on-conflict=version an album that's already at the destination is put
+// in a timestamped subfolder instead.
+func conflict_dest(ctx *cli.Context, dest string) string {
+	if ctx.String("on-conflict") != "version" || !rsync_exists(dest) {
+		return dest
+	}
+	versioned := dest + "/" + time.Now().Format("20060102-150405")
+	log.Warn("Album already uploaded, uploading a new version", "destination", versioned)
+	return versioned
+}
+
+// versioned_output returns the first of "name (2).ext", "name (3).ext", ...
+// that doesn't exist.
+func versioned_output(output string) string {
+	ext := filepath.Ext(output)
+	stem := strings.TrimSuffix(output, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
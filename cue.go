@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cue_track is a TRACK entry of a cue sheet.
+type cue_track struct {
+	number    int
+	file      string
+	title     string
+	performer string
+	start     float64 // INDEX 01, in seconds
+}
+
+// cue_sheet holds the parts of a cue sheet used for tagging and splitting.
+type cue_sheet struct {
+	performer string
+	title     string
+	date      string
+	genre     string
+	tracks    []cue_track
+}
+
+// cue_field returns the value of a cue command, unquoted.
+func cue_field(line string, command string) (string, bool) {
+	value, ok := strings.CutPrefix(line, command+" ")
+	if !ok {
+		return "", false
+	}
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, `"`) {
+		if end := strings.LastIndex(value, `"`); end > 0 {
+			value = value[1:end]
+		}
+	}
+	return value, true
+}
+
+// cue_file returns the name from the value of a FILE command, dropping
+// the type that follows it: "name" WAVE. Names that aren't quoted, or are
+// missing the closing quote, end at the last space.
+func cue_file(value string) string {
+	value = strings.TrimSpace(value)
+	if name, ok := strings.CutPrefix(value, `"`); ok {
+		if end := strings.LastIndex(name, `"`); end >= 0 {
+			return name[:end]
+		}
+		value = name
+	}
+	if i := strings.LastIndex(value, " "); i > 0 {
+		value = value[:i]
+	}
+	return value
+}
+
+// cue_time parses an mm:ss:ff index, with 75 frames a second.
+func cue_time(s string) float64 {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	m, _ := strconv.Atoi(parts[0])
+	sec, _ := strconv.Atoi(parts[1])
+	frames, _ := strconv.Atoi(parts[2])
+	return float64(m*60+sec) + float64(frames)/75
+}
+
+func parse_cue(filename string) (*cue_sheet, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sheet := &cue_sheet{}
+	var file string
+	var track *cue_track
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if value, ok := strings.CutPrefix(line, "FILE "); ok {
+			file = cue_file(value)
+		} else if value, ok := cue_field(line, "TRACK"); ok {
+			number, _ := strconv.Atoi(strings.Fields(value)[0])
+			sheet.tracks = append(sheet.tracks, cue_track{number: number, file: file})
+			track = &sheet.tracks[len(sheet.tracks)-1]
+		} else if value, ok := cue_field(line, "TITLE"); ok {
+			if track != nil {
+				track.title = value
+			} else {
+				sheet.title = value
+			}
+		} else if value, ok := cue_field(line, "PERFORMER"); ok {
+			if track != nil {
+				track.performer = value
+			} else {
+				sheet.performer = value
+			}
+		} else if value, ok := cue_field(line, "INDEX"); ok && track != nil {
+			if fields := strings.Fields(value); len(fields) == 2 && fields[0] == "01" {
+				track.start = cue_time(fields[1])
+			}
+		} else if value, ok := cue_field(line, "REM DATE"); ok {
+			sheet.date = value
+		} else if value, ok := cue_field(line, "REM GENRE"); ok {
+			sheet.genre = value
+		}
+	}
+	return sheet, scanner.Err()
+}
+
+var info_track = regexp.MustCompile(`^\s*(\d{1,3})[.)\-\s]+\s*(.+?)(\s+\(?\d+:\d\d\)?)?\s*$`)
+
+// parse_infotext reads a plain text track listing: "Artist - Album" on the
+// first line, then lines like "01. Title" or "1 - Title 3:45". Other lines
+// are ignored, but the tracks have to be numbered in order from 1, so other
+// text files such as READMEs and lyrics aren't taken for listings.
+func parse_infotext(filename string) (*cue_sheet, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	sheet := &cue_sheet{}
+	header := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "\ufeff"))
+		if line == "" {
+			continue
+		}
+		if !header {
+			artist, album, ok := strings.Cut(line, " - ")
+			if !ok {
+				return nil, fmt.Errorf("%s: no \"Artist - Album\" line", filename)
+			}
+			sheet.performer, sheet.title = strings.TrimSpace(artist), strings.TrimSpace(album)
+			header = true
+			continue
+		}
+		if m := info_track.FindStringSubmatch(line); m != nil {
+			number, _ := strconv.Atoi(m[1])
+			if number != len(sheet.tracks)+1 {
+				return nil, fmt.Errorf("%s: track %d out of order", filename, number)
+			}
+			sheet.tracks = append(sheet.tracks, cue_track{number: number, title: m[2]})
+		}
+	}
+	if len(sheet.tracks) == 0 {
+		return nil, fmt.Errorf("%s: no tracks", filename)
+	}
+	return sheet, nil
+}
+
+var track_sheets = map[string]*cue_sheet{}
+var track_sheets_mu sync.Mutex
+
+// directory_sheet returns the cue sheet, or failing that the info text, in
+// dir. Sheets are parsed once per directory.
+func directory_sheet(dir string) *cue_sheet {
+	track_sheets_mu.Lock()
+	defer track_sheets_mu.Unlock()
+	if sheet, ok := track_sheets[dir]; ok {
+		return sheet
+	}
+	var sheet *cue_sheet
+	entries, _ := os.ReadDir(dir)
+	for _, parse := range []struct {
+		ext   string
+		parse func(string) (*cue_sheet, error)
+	}{{".cue", parse_cue}, {".txt", parse_infotext}} {
+		for _, entry := range entries {
+			if strings.EqualFold(filepath.Ext(entry.Name()), parse.ext) {
+				if s, err := parse.parse(filepath.Join(dir, entry.Name())); err == nil && len(s.tracks) > 0 {
+					sheet = s
+					break
+				}
+			}
+		}
+		if sheet != nil {
+			break
+		}
+	}
+	track_sheets[dir] = sheet
+	return sheet
+}
+
+var leading_number = regexp.MustCompile(`^\d+`)
+
+// find_track finds the entry for filename, by the cue FILE name or else
+// by track number.
+func (sheet *cue_sheet) find_track(filename string, tags Tags) *cue_track {
+	base := filepath.Base(filename)
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	for i, track := range sheet.tracks {
+		file := filepath.Base(track.file)
+		if track.file != "" && strings.EqualFold(strings.TrimSuffix(file, filepath.Ext(file)), stem) {
+			return &sheet.tracks[i]
+		}
+	}
+	n, ok := parse_track(tags.Track)
+	if !ok {
+		if n, ok = parse_track(leading_number.FindString(base)); !ok {
+			return nil
+		}
+	}
+	for i, track := range sheet.tracks {
+		if track.number == n {
+			return &sheet.tracks[i]
+		}
+	}
+	return nil
+}
+
+// Tags are taken first from the file, then from a .cue sheet or text track
+// listing alongside it, then parsed from the path with --tag-from-path, and
+// then from the override flags.
+
+// sheet_tags fills tags missing from a file from the cue sheet or info text
+// in its directory.
+func sheet_tags(filename string, tags Tags) Tags {
+	if tags.Title != "" && tags.Album != "" && (tags.Artist != "" || tags.AlbumArtist != "") {
+		return tags
+	}
+	sheet := directory_sheet(filepath.Dir(filename))
+	if sheet == nil {
+		return tags
+	}
+	fallback := Tags{
+		Album:       sheet.title,
+		AlbumArtist: sheet.performer,
+		Artist:      sheet.performer,
+		Date:        sheet.date,
+		Genre:       sheet.genre,
+	}
+	if track := sheet.find_track(filename, tags); track != nil {
+		fallback.Title = track.title
+		fallback.Track = strconv.Itoa(track.number)
+		if track.performer != "" {
+			fallback.Artist = track.performer
+		}
+	}
+	return merge_tags(tags, fallback)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func write_sheet(t *testing.T, name string, text string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestParseCue(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want *cue_sheet
+	}{
+		{
+			"album",
+			"\ufeffREM GENRE Jazz\nREM DATE 1959\nPERFORMER \"Miles Davis\"\nTITLE \"Kind of Blue\"\n" +
+				"FILE \"Kind of Blue.flac\" WAVE\n" +
+				"  TRACK 01 AUDIO\n    TITLE \"So What\"\n    INDEX 01 00:00:00\n" +
+				"  TRACK 02 AUDIO\n    TITLE \"Freddie Freeloader\"\n    PERFORMER \"Miles Davis Sextet\"\n    INDEX 00 09:20:10\n    INDEX 01 09:22:37\n",
+			&cue_sheet{performer: "Miles Davis", title: "Kind of Blue", date: "1959", genre: "Jazz", tracks: []cue_track{
+				{number: 1, file: "Kind of Blue.flac", title: "So What"},
+				{number: 2, file: "Kind of Blue.flac", title: "Freddie Freeloader", performer: "Miles Davis Sextet", start: 562 + 37.0/75},
+			}},
+		},
+		{
+			"file per track",
+			"FILE \"01 - Intro.wav\" WAVE\nTRACK 1 AUDIO\nFILE 02.wav WAVE\nTRACK 2 AUDIO\n",
+			&cue_sheet{tracks: []cue_track{{number: 1, file: "01 - Intro.wav"}, {number: 2, file: "02.wav"}}},
+		},
+		{
+			"unclosed quote",
+			"FILE \"broken.wav WAVE\nTRACK 01 AUDIO\nTITLE \"Unclosed\n",
+			&cue_sheet{tracks: []cue_track{{number: 1, file: "broken.wav", title: "\"Unclosed"}}},
+		},
+		{
+			"lone quote",
+			"FILE \"\nTRACK 01 AUDIO\n",
+			&cue_sheet{tracks: []cue_track{{number: 1, file: ""}}},
+		},
+	}
+	for _, tt := range tests {
+		sheet, err := parse_cue(write_sheet(t, "album.cue", tt.text))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(sheet, tt.want) {
+			t.Errorf("%s: parse_cue = %+v, want %+v", tt.name, sheet, tt.want)
+		}
+	}
+}
+
+func TestParseInfotext(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want *cue_sheet
+	}{
+		{
+			"listing",
+			"Grateful Dead - Cornell 1977\n\nSource: SBD > DAT\n\nSet I\n01. New Minglewood Blues 5:11\n2) Loser (7:24)\n03 - El Paso\n",
+			&cue_sheet{performer: "Grateful Dead", title: "Cornell 1977", tracks: []cue_track{
+				{number: 1, title: "New Minglewood Blues"}, {number: 2, title: "Loser"}, {number: 3, title: "El Paso"},
+			}},
+		},
+		{"no header", "01. So What\n02. Freddie Freeloader\n", nil},
+		{"readme", "Building - read this first\n\n3. Run make\n4. Install\n", nil},
+		{"lyrics", "Johnny Cash - I Walk the Line\n\nI keep a close watch on this heart of mine\nI keep my eyes wide open all the time\n", nil},
+		{"gap", "Artist - Album\n1. One\n3. Three\n", nil},
+	}
+	for _, tt := range tests {
+		sheet, err := parse_infotext(write_sheet(t, "info.txt", tt.text))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: parse_infotext = %+v, want an error", tt.name, sheet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(sheet, tt.want) {
+			t.Errorf("%s: parse_infotext = %+v, want %+v", tt.name, sheet, tt.want)
+		}
+	}
+}
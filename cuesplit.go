@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cue_segment is a track's span of a single file album, from its cue
+// sheet.
+type cue_segment struct {
+	track cue_track
+	end   float64 // the next track's start, or 0 for the end of the file
+}
+
+func stem(filename string) string {
+	base := filepath.Base(filename)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// single_file_sheet returns the cue sheet splitting the only audio file of
+// a directory into tracks, or nil if it isn't a single file album. The cue
+// FILE often names a .wav the FLAC was encoded from, so only the names are
+// compared.
+func single_file_sheet(files []string) *cue_sheet {
+	if len(files) != 1 {
+		return nil
+	}
+	sheet := directory_sheet(filepath.Dir(files[0]))
+	if sheet == nil || len(sheet.tracks) < 2 {
+		return nil
+	}
+	for _, track := range sheet.tracks {
+		// text listings have no FILE, nor times to split at
+		if track.file == "" || !strings.EqualFold(stem(track.file), stem(files[0])) {
+			return nil
+		}
+	}
+	return sheet
+}
+
+// cue_jobs splits a job for a single file album into one for each track.
+func cue_jobs(j job, sheet *cue_sheet) []job {
+	var jobs []job
+	for i, track := range sheet.tracks {
+		segment := &cue_segment{track: track}
+		if i+1 < len(sheet.tracks) {
+			segment.end = sheet.tracks[i+1].start
+		}
+		j.cue = segment
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+// apply retags the metadata of a single file album for the segment's
+// track. The tags are also added, so they're written over the file's own.
+func (segment *cue_segment) apply(metadata *Metadata) {
+	if duration, err := strconv.ParseFloat(metadata.Format.Duration, 64); err == nil {
+		end := segment.end
+		if end == 0 {
+			end = duration
+		}
+		metadata.Format.Duration = strconv.FormatFloat(end-segment.track.start, 'f', 3, 64)
+	}
+	for _, tags := range []*Tags{&metadata.Format.Tags, &metadata.Added} {
+		tags.Title = segment.track.title
+		tags.Track = strconv.Itoa(segment.track.number)
+		if segment.track.performer != "" {
+			tags.Artist = segment.track.performer
+		}
+	}
+}
+
+// input_args seek the input to the segment.
+func (segment *cue_segment) input_args() []string {
+	args := []string{"-ss", strconv.FormatFloat(segment.track.start, 'f', 3, 64)}
+	if segment.end > 0 {
+		args = append(args, "-to", strconv.FormatFloat(segment.end, 'f', 3, 64))
+	}
+	return args
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/charmbracelet/log"
+)
+
+var dedupe_methods = []string{"", "tags", "pcm"}
+
+var lossless_codecs = []string{"flac", "alac", "wavpack", "ape", "tta"}
+
+func is_lossless(codec string) bool {
+	return strings.HasPrefix(codec, "pcm_") || slices.Contains(lossless_codecs, codec)
+}
+
+// fingerprint identifies the audio content of a file. The tags method
+// matches on tags and duration, so finds the same track in different
+// codecs; pcm hashes the decoded audio, so only finds exact copies.
+// Untagged files have no tags fingerprint, as they'd all match.
+func fingerprint(method string, filename string, metadata Metadata) (string, error) {
+	if method == "tags" {
+		tags := metadata.Format.Tags
+		if tags.Artist == "" && tags.AlbumArtist == "" && tags.Album == "" && tags.Title == "" {
+			return "", nil
+		}
+		duration, _ := strconv.ParseFloat(metadata.Format.Duration, 64)
+		return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%.0f", strings.ToLower(tags.AlbumArtist), strings.ToLower(tags.Album),
+			strings.ToLower(tags.Title), tags.Track, math.Round(duration)), nil
+	}
+	ffmpeg := exec.Command("ffmpeg", "-nostdin", "-v", "error", "-i", filename, "-map", "0:a:0", "-f", "hash", "-hash", "sha256", "-")
+	out, err := ffmpeg.Output()
+	if err != nil {
+		return "", fmt.Errorf("hashing %s: %w", filename, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// quality ranks sources for keeping the best of a set of duplicates:
+// lossless first, then by bitrate.
+func quality(metadata Metadata) float64 {
+	if stream := audio_stream(metadata); stream != nil && is_lossless(stream.CodecName) {
+		return math.Inf(1)
+	}
+	bitrate, _ := strconv.ParseFloat(metadata.Format.BitRate, 64)
+	return bitrate
+}
+
+// dedupe removes jobs with the same audio content, keeping the highest
+// quality source of each.
+func dedupe(method string, jobs []job) []job {
+	type probed struct {
+		key     string
+		quality float64
+	}
+	results := make([]probed, len(jobs))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, probe_jobs)
+	for i, j := range jobs {
+		wg.Add(1)
+		go func(i int, j job) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if j.cue != nil {
+				// tracks cut from one file all probe as that file
+				return
+			}
+			metadata, err := get_metadata(j.input)
+			if err != nil {
+				// leave it to the conversion to report
+				return
+			}
+			key, err := fingerprint(method, j.input, metadata)
+			if err != nil {
+				log.Warn("Dedupe failed", "file", path.Base(j.input), "error", err)
+				return
+			}
+			results[i] = probed{key, quality(metadata)}
+		}(i, j)
+	}
+	wg.Wait()
+
+	best := map[string]int{}
+	for i, r := range results {
+		if r.key == "" {
+			continue
+		}
+		if b, ok := best[r.key]; !ok || r.quality > results[b].quality {
+			best[r.key] = i
+		}
+	}
+	var kept []job
+	for i, j := range jobs {
+		r := results[i]
+		if b, ok := best[r.key]; r.key != "" && ok && b != i {
+			log.Info("♊ Deduped", "file", path.Base(j.input), "duplicate of", path.Base(jobs[b].input))
+			continue
+		}
+		kept = append(kept, j)
+	}
+	return kept
+}
@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+func file_device(filename string) (uint64, bool) {
+	return 0, false
+}
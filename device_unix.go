@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// file_device returns the id of the device holding filename.
+func file_device(filename string) (uint64, bool) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return 0, false
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(sys.Dev), true
+}
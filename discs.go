@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parse_disc parses a disc tag such as "1" or "1/2", returning zeros for
+// missing parts.
+func parse_disc(s string) (disc int, total int) {
+	n, of, _ := strings.Cut(strings.TrimSpace(s), "/")
+	disc, _ = strconv.Atoi(strings.TrimSpace(n))
+	total, _ = strconv.Atoi(strings.TrimSpace(of))
+	return disc, total
+}
+
+// disc_folders moves the jobs of multi-disc albums into "Disc N"
+// subdirectories of outputdir. Single disc albums are left flat.
+func disc_folders(jobs []job, outputdir string) ([]job, error) {
+	metadata := probe_all(jobs)
+	discs := map[int]bool{}
+	multi := false
+	for _, m := range metadata {
+		disc, total := parse_disc(m.Format.Tags.Disc)
+		discs[disc] = true
+		multi = multi || total > 1
+	}
+	if !multi && len(discs) < 2 {
+		return jobs, nil
+	}
+
+	jobs = append([]job(nil), jobs...)
+	for i, m := range metadata {
+		disc, _ := parse_disc(m.Format.Tags.Disc)
+		if disc == 0 {
+			continue
+		}
+		dir := filepath.Join(outputdir, normalize_name(fmt.Sprintf("Disc %d", disc)))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+		jobs[i].outputdir = dir
+	}
+	return jobs, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// min_free_space is the space in bytes that must be left on the temp and
+// output filesystems to start another conversion, from --min-free-space.
+var min_free_space uint64
+
+var err_low_space = errors.New("low disk space")
+
+var size_units = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"tb", 1e12}, {"gb", 1e9}, {"mb", 1e6}, {"kb", 1e3},
+	{"t", 1e12}, {"g", 1e9}, {"m", 1e6}, {"k", 1e3}, {"b", 1},
+}
+
+// parse_size parses a size like 500MB or 2GB. A bare number is in bytes.
+func parse_size(s string) (uint64, error) {
+	number := strings.ToLower(strings.TrimSpace(s))
+	multiplier := 1.0
+	for _, unit := range size_units {
+		if n, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(n), unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("expected a size like 500MB or 2GB: %s", s)
+	}
+	return uint64(size * multiplier), nil
+}
+
+// existing_dir returns dir, or its closest parent that exists, as the
+// output directory of a disc may not have been created yet.
+func existing_dir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// check_free_space returns an error wrapping err_low_space when any of the
+// dirs has less than --min-free-space available. Filesystems whose free
+// space can't be read are skipped.
+func check_free_space(dirs ...string) error {
+	if min_free_space == 0 {
+		return nil
+	}
+	for _, dir := range dirs {
+		dir = existing_dir(dir)
+		free, err := free_space(dir)
+		if err != nil {
+			log.Debug("Free space check skipped", "dir", dir, "error", err)
+			continue
+		}
+		if free < min_free_space {
+			return fmt.Errorf("%w: %s free on %s, below --min-free-space of %s", err_low_space, format_size(float64(free)), dir, format_size(float64(min_free_space)))
+		}
+	}
+	return nil
+}
+
+// stops_run reports whether an error should end the whole run rather than
+// just its album: with --fail-fast, or when the disk is nearly full.
+func stops_run(ctx *cli.Context, err error) bool {
+	return ctx.Bool("fail-fast") || errors.Is(err, err_low_space)
+}
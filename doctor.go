@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+var doctor_command = &cli.Command{
+	Name:   "doctor",
+	Usage:  "check the tools audioconvert needs are installed and working",
+	Action: doctor,
+}
+
+// doctor_check is one line of the doctor report. Optional checks only
+// warn when they fail.
+type doctor_check struct {
+	name     string
+	ok       bool
+	optional bool
+	detail   string
+}
+
+func (c doctor_check) String() string {
+	status := "✅"
+	if !c.ok && c.optional {
+		status = "⚠️"
+	} else if !c.ok {
+		status = "❌"
+	}
+	return fmt.Sprintf("%s %s: %s", status, c.name, c.detail)
+}
+
+// tool_version checks a command is installed, returning the first line of
+// its version output.
+func tool_version(name string, optional bool, args ...string) doctor_check {
+	if _, err := exec.LookPath(name); err != nil {
+		return doctor_check{name, false, optional, "not found"}
+	}
+	out, err := exec.Command(name, args...).CombinedOutput()
+	version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if err != nil && version == "" {
+		return doctor_check{name, false, optional, err.Error()}
+	}
+	return doctor_check{name, true, optional, version}
+}
+
+// available_encoders returns the names of the encoders ffmpeg was built
+// with.
+func available_encoders() (map[string]bool, error) {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg -encoders failed: %w", err)
+	}
+	available := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && len(fields[0]) == 6 {
+			available[fields[1]] = true
+		}
+	}
+	return available, nil
+}
+
+// encoder_checks checks ffmpeg has the encoder of each preset.
+func encoder_checks() []doctor_check {
+	available, err := available_encoders()
+	if err != nil {
+		return []doctor_check{{"encoders", false, false, "ffmpeg -encoders failed"}}
+	}
+	var presets []string
+	for name := range transcoder_presets {
+		presets = append(presets, name)
+	}
+	slices.Sort(presets)
+	var checks []doctor_check
+	for _, name := range presets {
+		codec := transcoder_presets[name].codec
+		detail := codec
+		if !available[codec] {
+			detail += " encoder missing"
+		}
+		checks = append(checks, doctor_check{"preset " + name, available[codec], false, detail})
+	}
+	return checks
+}
+
+// tmpdir_check checks the temporary directory is writable and reports its
+// free space.
+func tmpdir_check() doctor_check {
+	dir := os.TempDir()
+	f, err := os.CreateTemp(dir, "audioconvert")
+	if err != nil {
+		return doctor_check{"temp dir", false, false, err.Error()}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	detail := dir + " is writable"
+	if free, err := free_space(dir); err == nil {
+		detail += fmt.Sprintf(", %.1fGB free", float64(free)/1e9)
+	}
+	return doctor_check{"temp dir", true, false, detail}
+}
+
+// pipeline_check converts a generated second of sine wave with the opus
+// preset, and probes the result.
+func pipeline_check(ctx *cli.Context) doctor_check {
+	name := "conversion"
+	tmpdir, err := os.MkdirTemp("", "audioconvert")
+	if err != nil {
+		return doctor_check{name, false, false, err.Error()}
+	}
+	defer os.RemoveAll(tmpdir)
+
+	input := filepath.Join(tmpdir, "sine.flac")
+	ffmpeg := exec.Command("ffmpeg", "-nostdin", "-hide_banner", "-v", "error",
+		"-f", "lavfi", "-i", "sine=frequency=440:duration=1", "-ac", "2", input)
+	if out, err := ffmpeg.CombinedOutput(); err != nil {
+		return doctor_check{name, false, false, fmt.Sprintf("generating sample: %s", strings.TrimSpace(string(out)))}
+	}
+	metadata, err := get_metadata(input)
+	if err != nil {
+		return doctor_check{name, false, false, err.Error()}
+	}
+	t := preset_transcoder(ctx, "opus")
+	output := filepath.Join(tmpdir, "sine."+t.extension)
+	start := time.Now()
+	if err := convert(ctx.Context, transcoder_command(ctx, t, job{input: input}, metadata), input, output, metadata, func(float64) {}); err != nil {
+		return doctor_check{name, false, false, err.Error()}
+	}
+	converted, err := get_metadata(output)
+	if err != nil {
+		return doctor_check{name, false, false, err.Error()}
+	}
+	if stream := audio_stream(converted); stream == nil || stream.CodecName != "opus" {
+		return doctor_check{name, false, false, "output has no opus stream"}
+	}
+	return doctor_check{name, true, false, fmt.Sprintf("opus preset converted a sample in %s", time.Since(start).Round(time.Millisecond))}
+}
+
+func doctor(ctx *cli.Context) error {
+	log.SetTimeFormat(time.Kitchen)
+	set_log_level(ctx.String("log-level"))
+
+	checks := []doctor_check{
+		tool_version("ffmpeg", false, "-version"),
+		tool_version("ffprobe", false, "-version"),
+		tool_version("rsync", true, "--version"),
+		tool_version("ssh", true, "-V"),
+		tool_version("flac", true, "--version"),
+	}
+	if checks[0].ok {
+		checks = append(checks, encoder_checks()...)
+	}
+	checks = append(checks, tmpdir_check())
+	if checks[0].ok && checks[1].ok {
+		checks = append(checks, pipeline_check(ctx))
+	}
+
+	failed := 0
+	for _, c := range checks {
+		fmt.Println(c)
+		if !c.ok && !c.optional {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
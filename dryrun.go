@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// planned_conversion is an entry of the --dry-run-json plan. Inputs from
+// zips are given as paths inside the zip, and without --output-dir outputs
+// are relative to the output directory, so plans diff cleanly across runs.
+type planned_conversion struct {
+	Input        string   `json:"input"`
+	Output       string   `json:"output"`
+	Command      string   `json:"command"`
+	Destinations []string `json:"destinations,omitempty"`
+}
+
+var dry_run_plan []planned_conversion
+
+// plan_jobs adds the conversions of an album to the plan, without running
+// them. Tags are still probed, unless --numbered, as outputs are named
+// from them.
+func plan_jobs(ctx *cli.Context, jobs []job, outputdir string, dests []string) error {
+	t := get_transcoder(ctx)
+	for _, j := range jobs {
+		t := job_transcoder(ctx, t, j)
+		metadata, err := job_metadata(t, j)
+		if err != nil {
+			return err
+		}
+		output, err := output_path(ctx, t, j, metadata)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(outputdir, output)
+		if err != nil {
+			return err
+		}
+		p := planned_conversion{
+			Input:   j.input,
+			Output:  rel,
+			Command: transcoder_command(ctx, t, j, metadata).String(),
+		}
+		if j.origin != "" {
+			p.Input = j.origin
+		}
+		if ctx.String("output-dir") != "" {
+			p.Output = output
+		}
+		for _, dest := range dests {
+			p.Destinations = append(p.Destinations, dest+"/"+filepath.ToSlash(rel))
+		}
+		dry_run_plan = append(dry_run_plan, p)
+	}
+	return nil
+}
+
+// write_plan prints the plan as JSON, sorted by input.
+func write_plan() error {
+	slices.SortFunc(dry_run_plan, func(a, b planned_conversion) int {
+		if c := strings.Compare(a.Input, b.Input); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Output, b.Output)
+	})
+	if dry_run_plan == nil {
+		dry_run_plan = []planned_conversion{}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dry_run_plan)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// flac_ratio is the typical size of FLAC relative to the PCM it encodes.
+const flac_ratio = 0.6
+
+// vbr_bitrates are the average bitrates of the quality based presets, as
+// they have no fixed bitrate to estimate from.
+var vbr_bitrates = map[string]map[string]float64{
+	"libmp3lame": {"0": 245000, "2": 190000, "5": 130000},
+	"libvorbis":  {"1": 80000, "5": 160000, "10": 500000},
+}
+
+const default_bitrate = 128000
+
+// estimate_total is the estimated output size of all the albums so far.
+var estimate_total struct {
+	tracks int
+	bytes  float64
+}
+
+// parse_bitrate parses ffmpeg bitrates such as 160k or 1.5M.
+func parse_bitrate(s string) (float64, error) {
+	scale := 1.0
+	if strings.HasSuffix(s, "k") {
+		scale, s = 1000, strings.TrimSuffix(s, "k")
+	} else if strings.HasSuffix(s, "M") {
+		scale, s = 1000000, strings.TrimSuffix(s, "M")
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return n * scale, err
+}
+
+// pcm_rate returns the PCM bitrate of a stream at the given bit depth, or
+// the stream's own when bits is 0.
+func pcm_rate(stream *Stream, bits int) float64 {
+	if stream == nil {
+		return 44100 * 2 * 16
+	}
+	rate, _ := strconv.Atoi(stream.SampleRate)
+	if bits == 0 {
+		if bits, _ = strconv.Atoi(stream.BitsPerRawSample); bits == 0 {
+			bits = 16
+		}
+	}
+	return float64(rate * stream.Channels * bits)
+}
+
+// output_bitrate estimates the bitrate a track converts at: the preset's
+// own for lossy presets, and from the source for lossless ones.
+func output_bitrate(ctx *cli.Context, t transcoder, j job, metadata Metadata) float64 {
+	source, _ := strconv.ParseFloat(metadata.Format.BitRate, 64)
+	stream := audio_stream(metadata)
+	if t.command != "" || t.name == "remux" {
+		return source
+	}
+	codec := t.preset.codec
+	switch {
+	case strings.HasPrefix(codec, "pcm_s"):
+		bits, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(codec, "pcm_s"), "le"))
+		return pcm_rate(stream, bits)
+	case is_lossless(codec):
+		if stream != nil && is_lossless(stream.CodecName) && source > 0 {
+			return source
+		}
+		return pcm_rate(stream, 0) * flac_ratio
+	}
+	args := transcoder_command(ctx, t, j, metadata).args
+	if i := slices.Index(args, "-b:a"); i >= 0 && i+1 < len(args) {
+		if bitrate, err := parse_bitrate(args[i+1]); err == nil {
+			return bitrate
+		}
+	}
+	if i := slices.Index(args, "-q:a"); i >= 0 && i+1 < len(args) {
+		if bitrate, ok := vbr_bitrates[codec][args[i+1]]; ok {
+			return bitrate
+		}
+	}
+	return default_bitrate
+}
+
+func format_size(bytes float64) string {
+	switch {
+	case bytes >= 1e9:
+		return fmt.Sprintf("%.1fGB", bytes/1e9)
+	case bytes >= 1e6:
+		return fmt.Sprintf("%.1fMB", bytes/1e6)
+	}
+	return fmt.Sprintf("%.0fkB", bytes/1e3)
+}
+
+// estimate_jobs prints the estimated output size of an album, from its
+// durations and the preset's bitrate, without converting it.
+func estimate_jobs(ctx *cli.Context, jobs []job) error {
+	t := get_transcoder(ctx)
+	var album string
+	var seconds, bytes float64
+	for _, j := range jobs {
+		t := job_transcoder(ctx, t, j)
+		metadata, err := get_metadata(j.input)
+		if err != nil {
+			return err
+		}
+		if j.cue != nil {
+			j.cue.apply(&metadata)
+		}
+		if album == "" {
+			album = metadata.Format.Tags.AlbumArtist + " - " + metadata.Format.Tags.Album
+		}
+		duration, err := strconv.ParseFloat(metadata.Format.Duration, 64)
+		if err != nil {
+			continue
+		}
+		if _, length, ok := sample_window(ctx, metadata); ok {
+			duration = length
+		}
+		seconds += duration
+		bytes += duration * output_bitrate(ctx, t, j, metadata) / 8
+	}
+	fmt.Printf("%s: %d tracks, %s, ~%s\n", album, len(jobs), format_duration(seconds), format_size(bytes))
+	estimate_total.tracks += len(jobs)
+	estimate_total.bytes += bytes
+	return nil
+}
+
+func format_duration(seconds float64) string {
+	s := int(seconds)
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
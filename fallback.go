@@ -0,0 +1,35 @@
+package main
+
+import (
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// select_fallback_preset makes the first of --transcoder-preset and the
+// --format-fallback presets whose encoder ffmpeg has the preset for the
+// run, so scripts work with ffmpeg builds lacking some encoders.
+func select_fallback_preset(ctx *cli.Context) {
+	var candidates []string
+	if name := ctx.String("transcoder-preset"); name != "" {
+		candidates = append(candidates, name)
+	}
+	candidates = append(candidates, ctx.StringSlice("format-fallback")...)
+	encoders, err := available_encoders()
+	if err != nil {
+		log.Warn("Couldn't detect the available encoders, not falling back", "error", err)
+		return
+	}
+	for i, name := range candidates {
+		t := preset_transcoder(ctx, name)
+		if t.preset.codec != "copy" && !encoders[t.preset.codec] {
+			log.Debug("Encoder unavailable", "preset", t.name, "codec", t.preset.codec)
+			continue
+		}
+		if i > 0 {
+			log.Warn("Falling back to a preset with an available encoder", "preset", t.name, "unavailable", candidates[:i])
+		}
+		ctx.Set("transcoder-preset", t.name)
+		return
+	}
+	log.Fatal("None of the presets' encoders are available", "presets", candidates)
+}
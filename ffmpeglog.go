@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+)
+
+var ffmpeg_loglevels = []string{"error", "warning", "info"}
+
+// max_ffmpeg_warnings limits how many distinct warnings are reported for
+// each conversion.
+const max_ffmpeg_warnings = 10
+
+// ffmpeg_warning returns the message of a warning line, which ffmpeg marks
+// with "[warning]" when run with -loglevel level+...
+func ffmpeg_warning(line string) (string, bool) {
+	_, msg, ok := strings.Cut(line, "[warning] ")
+	return strings.TrimSpace(msg), ok && strings.TrimSpace(msg) != ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ffmpeg_version_re = regexp.MustCompile(`^ffmpeg version n?(\d+(?:\.\d+)*)`)
+
+// ffmpeg_version returns the release of the installed ffmpeg, like 6.1.1,
+// from the first line of ffmpeg -version. Git builds have no release number.
+var ffmpeg_version = sync.OnceValues(func() (string, error) {
+	out, err := exec.Command("ffmpeg", "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg -version failed: %w", err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	m := ffmpeg_version_re.FindStringSubmatch(line)
+	if m == nil {
+		return "", fmt.Errorf("no release version in %q", strings.TrimSpace(line))
+	}
+	return m[1], nil
+})
+
+var version_re = regexp.MustCompile(`^\d+(\.\d+)*$`)
+
+// compare_versions compares dotted version numbers, returning -1, 0 or 1.
+// Only the components of b are compared, so 6.1.1 equals 6.1.
+func compare_versions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range bs {
+		x := 0
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// check_ffmpeg_version checks the installed ffmpeg is at least minimum, and
+// is the required version, when they're set.
+func check_ffmpeg_version(minimum, required string) error {
+	if minimum == "" && required == "" {
+		return nil
+	}
+	version, err := ffmpeg_version()
+	if err != nil {
+		return err
+	}
+	if minimum != "" && compare_versions(version, minimum) < 0 {
+		return fmt.Errorf("ffmpeg %s is older than --min-ffmpeg-version %s", version, minimum)
+	}
+	if required != "" && compare_versions(version, required) != 0 {
+		return fmt.Errorf("ffmpeg %s isn't --require-ffmpeg-version %s", version, required)
+	}
+	return nil
+}
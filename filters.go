@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// probe_jobs is the number of files probed at once, set from pool_jobs.
+var probe_jobs = poolSize
+
+// probe_all probes the jobs in parallel. Metadata is left empty for files
+// that fail, so the conversion reports them.
+func probe_all(jobs []job) []Metadata {
+	results := make([]Metadata, len(jobs))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, probe_jobs)
+	for i, j := range jobs {
+		wg.Add(1)
+		go func(i int, j job) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			var err error
+			if results[i], err = get_metadata(j.input); err == nil && j.cue != nil {
+				j.cue.apply(&results[i])
+			}
+		}(i, j)
+	}
+	wg.Wait()
+	return results
+}
+
+// codec_matches reports whether codec is in the --input-codec allowlist.
+// wav and pcm match any of the pcm codecs.
+func codec_matches(allow []string, codec string) bool {
+	if strings.HasPrefix(codec, "pcm_") && (slices.Contains(allow, "wav") || slices.Contains(allow, "pcm")) {
+		return true
+	}
+	return slices.Contains(allow, codec)
+}
+
+// duration_matches reports whether a duration in seconds is within the
+// --min-duration and --max-duration range. Unknown durations always match.
+func duration_matches(ctx *cli.Context, duration string) bool {
+	seconds, err := strconv.ParseFloat(duration, 64)
+	if err != nil {
+		return true
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	if min := ctx.Duration("min-duration"); min > 0 && d < min {
+		return false
+	}
+	if max := ctx.Duration("max-duration"); max > 0 && d > max {
+		return false
+	}
+	return true
+}
+
+// filter_jobs drops the inputs excluded by the --input-codec and duration
+// filters.
+func filter_jobs(ctx *cli.Context, jobs []job) []job {
+	allow := ctx.StringSlice("input-codec")
+	if len(allow) == 0 && ctx.Duration("min-duration") == 0 && ctx.Duration("max-duration") == 0 {
+		return jobs
+	}
+	var kept []job
+	for i, metadata := range probe_all(jobs) {
+		j := jobs[i]
+		if metadata.Format.Filename == "" {
+			// failed to probe, so the conversion reports it
+			kept = append(kept, j)
+			continue
+		}
+		if stream := audio_stream(metadata); len(allow) > 0 && (stream == nil || !codec_matches(allow, stream.CodecName)) {
+			codec := ""
+			if stream != nil {
+				codec = stream.CodecName
+			}
+			log.Info("⏭ Skipping", "file", path.Base(j.input), "codec", codec)
+			run_summary.count(&run_summary.skipped, 1)
+			continue
+		}
+		if !duration_matches(ctx, metadata.Format.Duration) {
+			log.Info("⏭ Skipping", "file", path.Base(j.input), "duration", metadata.Format.Duration)
+			run_summary.count(&run_summary.skipped, 1)
+			continue
+		}
+		kept = append(kept, j)
+	}
+	return kept
+}
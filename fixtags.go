@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tag_fix is a normalized tag value written by --fix-tags.
+type tag_fix struct {
+	key   string
+	from  string
+	value string
+}
+
+// normalize_tag trims whitespace, drops duplicate values (which ffmpeg joins
+// with ";") and replaces invalid UTF-8.
+func normalize_tag(value string) string {
+	value = strings.ToValidUTF8(value, "�")
+	var values []string
+	for _, v := range strings.Split(value, ";") {
+		v = strings.Join(strings.Fields(v), " ")
+		if v != "" && !slices.Contains(values, v) {
+			values = append(values, v)
+		}
+	}
+	return strings.Join(values, ";")
+}
+
+// normalize_track reduces values like "03" or "3/12" to a plain number.
+func normalize_track(value string) string {
+	value, _, _ = strings.Cut(strings.TrimSpace(value), "/")
+	if n, err := strconv.Atoi(value); err == nil {
+		return strconv.Itoa(n)
+	}
+	return value
+}
+
+// tag_fixes returns the tags that change when normalized.
+func tag_fixes(tags Tags) []tag_fix {
+	var fixes []tag_fix
+	v := reflect.ValueOf(tags)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() != reflect.String {
+			continue
+		}
+		key := tag_key(field)
+		from := v.Field(i).String()
+		value := normalize_tag(from)
+		if key == "track" {
+			value = normalize_track(value)
+		}
+		if value != from {
+			fixes = append(fixes, tag_fix{key, from, value})
+		}
+	}
+	return fixes
+}
+
+func tag_fix_args(fixes []tag_fix) []string {
+	var args []string
+	for _, fix := range fixes {
+		args = append(args, "-metadata", fix.key+"="+fix.value)
+	}
+	return args
+}
+
+// tag_key returns the ffmpeg metadata key of a Tags field.
+func tag_key(field reflect.StructField) string {
+	key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return key
+}
+
+// added_tags returns the fields set in tags but not in original.
+func added_tags(original Tags, tags Tags) Tags {
+	var added Tags
+	o := reflect.ValueOf(original)
+	v := reflect.ValueOf(tags)
+	a := reflect.ValueOf(&added).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.String && o.Field(i).String() == "" {
+			a.Field(i).SetString(v.Field(i).String())
+		}
+	}
+	return added
+}
+
+// tags_args returns the options writing the set fields of tags.
+func tags_args(tags Tags) []string {
+	var args []string
+	v := reflect.ValueOf(tags)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.String && v.Field(i).String() != "" {
+			args = append(args, "-metadata", tag_key(v.Type().Field(i))+"="+v.Field(i).String())
+		}
+	}
+	return args
+}
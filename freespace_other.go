@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+func free_space(dir string) (uint64, error) {
+	return 0, errors.New("free space isn't supported on this platform")
+}
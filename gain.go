@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+)
+
+var apply_gain_modes = []string{"", "from-tag", "from-album-tag"}
+
+// clear_gain_args blank the gain tags of outputs whose gain was applied.
+var clear_gain_args = []string{
+	"-metadata", "replaygain_track_gain=", "-metadata", "replaygain_track_peak=",
+	"-metadata", "replaygain_album_gain=", "-metadata", "replaygain_album_peak=",
+	"-metadata", "r128_track_gain=", "-metadata", "r128_album_gain=",
+}
+
+// parse_replaygain parses a ReplayGain value like "-6.50 dB".
+func parse_replaygain(value string) (float64, bool) {
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "dB"))
+	gain, err := strconv.ParseFloat(value, 64)
+	return gain, err == nil
+}
+
+// parse_r128 parses an R128 gain, a Q7.8 fixed point number of dB.
+func parse_r128(value string) (float64, bool) {
+	q, err := strconv.Atoi(strings.TrimSpace(value))
+	return float64(q) / 256, err == nil
+}
+
+// tag_gain returns the gain in dB to apply from a source's tags, for an
+// --apply-gain mode. Album gain falls back to the track's. ReplayGain is
+// preferred over R128, and positive gains are limited by the ReplayGain
+// peak so they don't clip.
+func tag_gain(mode string, tags Tags) (float64, bool) {
+	type gain_tags struct{ replaygain, peak, r128 string }
+	candidates := []gain_tags{{tags.TrackGain, tags.TrackPeak, tags.R128TrackGain}}
+	if mode == "from-album-tag" {
+		candidates = append([]gain_tags{{tags.AlbumGain, tags.AlbumPeak, tags.R128AlbumGain}}, candidates...)
+	}
+	for _, c := range candidates {
+		if gain, ok := parse_replaygain(c.replaygain); ok {
+			if peak, err := strconv.ParseFloat(strings.TrimSpace(c.peak), 64); err == nil && peak > 0 {
+				gain = min(gain, -20*math.Log10(peak))
+			}
+			return gain, true
+		}
+		if gain, ok := parse_r128(c.r128); ok {
+			return gain, true
+		}
+	}
+	return 0, false
+}
+
+// album_clip is a track that would clip played at its album gain, by how
+// far its peak would go over full scale.
+type album_clip struct {
+	Track string  `json:"track"`
+	File  string  `json:"file"`
+	Over  float64 `json:"over_db"`
+}
+
+// album_clips returns the tracks whose ReplayGain peak would clip at the
+// album gain, which players apply to every track alike. A track's headroom
+// is -20·log10(peak) less the album gain, and it clips when that's below
+// zero. Tracks without both tags are left out.
+func album_clips(outputs []conversion_result) []album_clip {
+	outputs = slices.Clone(outputs)
+	slices.SortFunc(outputs, compare_tracks)
+	var clips []album_clip
+	for _, o := range outputs {
+		tags := o.metadata.Format.Tags
+		gain, ok := parse_replaygain(tags.AlbumGain)
+		peak, err := strconv.ParseFloat(strings.TrimSpace(tags.TrackPeak), 64)
+		if !ok || err != nil || peak <= 0 {
+			continue
+		}
+		if headroom := -20*math.Log10(peak) - gain; headroom < 0 {
+			clips = append(clips, album_clip{Track: tags.Track, File: filepath.Base(o.output), Over: math.Round(-headroom*100) / 100})
+		}
+	}
+	return clips
+}
+
+// log_album_clips warns of the tracks of an album that would clip at its
+// album gain, so a limiter can be considered.
+func log_album_clips(outputs []conversion_result) {
+	for _, clip := range album_clips(outputs) {
+		log.Warn("Track would clip at album gain", "name", clip.File, "over", fmt.Sprintf("%.2f dB", clip.Over))
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAlbumClips(t *testing.T) {
+	result := func(output, track, album_gain, peak string) conversion_result {
+		var r conversion_result
+		r.output = "/out/" + output
+		r.metadata.Format.Tags = Tags{Track: track, AlbumGain: album_gain, TrackPeak: peak}
+		return r
+	}
+	outputs := []conversion_result{
+		result("03.opus", "3", "+2.00 dB", "0.988553"), // -20·log10(peak) is 0.10 dB
+		result("01.opus", "1", "+2.00 dB", "0.5"),      // 6.02 dB of headroom
+		result("02.opus", "2", "+2.00 dB", "1.0"),
+		result("04.opus", "4", "", "1.0"),
+		result("05.opus", "5", "+2.00 dB", ""),
+	}
+	got := album_clips(outputs)
+	want := []album_clip{{Track: "2", File: "02.opus", Over: 2}, {Track: "3", File: "03.opus", Over: 1.9}}
+	if !slices.Equal(got, want) {
+		t.Errorf("album_clips = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+)
+
+// ffmpeg's libopus wrapper records the encoder lookahead as the ogg pre-skip,
+// and the final page granule position trims the padding of the last packet,
+// so a standard conversion already plays back with exact track lengths.
+// What is left are the resampler and encoder transients at each track edge.
+// The accurate mode avoids these by decoding and resampling each disc as one
+// continuous stream, then cutting every track from it at exact samples.
+var gapless_modes = []string{"standard", "accurate"}
+
+const opus_rate = 48000
+
+// gapless_segment locates a track within the decoded album.
+type gapless_segment struct {
+	source string
+	start  int64 // first sample at 48kHz
+	end    int64
+}
+
+// seek is the whole second the album is seeked to before decoding a
+// track, so each track only decodes from just before its start. Whole
+// seconds are exact at 48kHz, so the trim still cuts at exact samples.
+func (segment *gapless_segment) seek() int64 {
+	return max(0, segment.start/opus_rate-1)
+}
+
+// input_args seek the album input to the segment.
+func (segment *gapless_segment) input_args() []string {
+	return []string{"-ss", strconv.FormatInt(segment.seek(), 10), "-i", segment.source}
+}
+
+// gapless_filter cuts the track from the album, counting samples from the
+// seek.
+func gapless_filter(segment *gapless_segment) string {
+	offset := segment.seek() * opus_rate
+	return fmt.Sprintf("atrim=start_sample=%d:end_sample=%d,asetpts=PTS-STARTPTS", segment.start-offset, segment.end-offset)
+}
+
+// track_samples returns the exact length of a track at 48kHz.
+func track_samples(metadata Metadata) (*big.Rat, error) {
+	stream := audio_stream(metadata)
+	if stream == nil {
+		return nil, fmt.Errorf("no audio stream")
+	}
+	timebase, ok := new(big.Rat).SetString(stream.TimeBase)
+	if !ok || stream.DurationTs == 0 {
+		return nil, fmt.Errorf("no exact duration")
+	}
+	samples := new(big.Rat).SetInt64(stream.DurationTs)
+	samples.Mul(samples, timebase)
+	return samples.Mul(samples, big.NewRat(opus_rate, 1)), nil
+}
+
+// prepare_gapless decodes the tracks of each output directory into one
+// continuous 48kHz stream, and points the jobs at their segment of it.
+func prepare_gapless(runctx context.Context, jobs []job, tmpdir string) ([]job, error) {
+	var discs []string
+	by_disc := map[string][]int{}
+	for i, j := range jobs {
+		if _, ok := by_disc[j.outputdir]; !ok {
+			discs = append(discs, j.outputdir)
+		}
+		by_disc[j.outputdir] = append(by_disc[j.outputdir], i)
+	}
+
+	jobs = append([]job(nil), jobs...)
+	for n, disc := range discs {
+		source := filepath.Join(tmpdir, fmt.Sprintf("album%d.wav", n))
+		var list strings.Builder
+		var format string
+		position := new(big.Rat)
+		for _, i := range by_disc[disc] {
+			metadata, err := get_metadata(jobs[i].input)
+			if err != nil {
+				return nil, err
+			}
+			stream := audio_stream(metadata)
+			samples, err := track_samples(metadata)
+			if err != nil {
+				return nil, fmt.Errorf("gapless %s: %w", jobs[i].input, err)
+			}
+			if f := stream.SampleRate + "/" + strconv.Itoa(stream.Channels); format == "" {
+				format = f
+			} else if f != format {
+				return nil, fmt.Errorf("gapless %s: tracks differ in sample rate or channels", disc)
+			}
+			start := round_rat(position)
+			position.Add(position, samples)
+			jobs[i].gapless = &gapless_segment{source, start, round_rat(position)}
+			fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(jobs[i].input, "'", `'\''`))
+		}
+
+		listfile := filepath.Join(tmpdir, fmt.Sprintf("album%d.txt", n))
+		if err := os.WriteFile(listfile, []byte(list.String()), 0644); err != nil {
+			return nil, err
+		}
+		log.Info("🔗 Decoding album for gapless conversion", "tracks", len(by_disc[disc]))
+		ffmpeg := exec.CommandContext(runctx, "ffmpeg", "-nostdin", "-hide_banner", "-v", "error",
+			"-f", "concat", "-safe", "0", "-i", listfile,
+			"-vn", "-ar", strconv.Itoa(opus_rate), "-c:a", "pcm_s32le", "-rf64", "auto", source)
+		if out, err := ffmpeg.CombinedOutput(); err != nil {
+			log.Error("Error", "error", err, "output", string(out))
+			return nil, fmt.Errorf("decoding album: %w", err)
+		}
+	}
+	return jobs, nil
+}
+
+func round_rat(r *big.Rat) int64 {
+	n := new(big.Int).Mul(r.Num(), big.NewInt(2))
+	n.Add(n, r.Denom())
+	return n.Div(n, new(big.Int).Mul(r.Denom(), big.NewInt(2))).Int64()
+}
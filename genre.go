@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// genre_map maps lowercased genres to their canonical form, loaded from
+// --genre-map. Canonical genres map to themselves.
+var genre_map map[string]string
+
+// load_genre_map reads a file of "from = to" lines. Blank lines and lines
+// starting with # are ignored.
+func load_genre_map(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	genres := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		from, to, ok := strings.Cut(line, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("%s:%d: expected from = to", filename, n)
+		}
+		genres[strings.ToLower(from)] = to
+		genres[strings.ToLower(to)] = to
+	}
+	return genres, scanner.Err()
+}
+
+// genre_fix returns the canonical genre to write for a source genre, or
+// false if it's unchanged. With --strict-genre unmapped genres are dropped.
+func genre_fix(ctx *cli.Context, genre string) (tag_fix, bool) {
+	if genre_map == nil || genre == "" {
+		return tag_fix{}, false
+	}
+	value, ok := genre_map[strings.ToLower(normalize_tag(genre))]
+	if !ok {
+		if !ctx.Bool("strict-genre") {
+			return tag_fix{}, false
+		}
+		value = ""
+	}
+	return tag_fix{"genre", genre, value}, value != genre
+}
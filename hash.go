@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// file_hash returns the hex SHA-256 of a file.
+func file_hash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, f, make([]byte, copy_buffer_size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// output_hash hashes an output for the json sidecar, or returns "" when
+// there's no sidecar to record it in. ffmpeg writes outputs itself, so
+// they're hashed just after, while still in the page cache.
+func output_hash(ctx *cli.Context, output string) string {
+	if ctx.String("sidecar") != "json" {
+		return ""
+	}
+	sum, err := file_hash(output)
+	if err != nil {
+		log.Warn("Failed to hash output", "name", output, "error", err)
+	}
+	return sum
+}
+
+// hashing_writer hashes what's written through it, for outputs that pass
+// through audioconvert, such as --stream.
+type hashing_writer struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func new_hashing_writer(w io.Writer) *hashing_writer {
+	h := sha256.New()
+	return &hashing_writer{io.MultiWriter(w, h), h}
+}
+
+func (hw *hashing_writer) Write(p []byte) (int, error) {
+	return hw.w.Write(p)
+}
+
+func (hw *hashing_writer) sum() string {
+	return hex.EncodeToString(hw.h.Sum(nil))
+}
+
+// write_source_checksum writes "<source>.sha256" into dir, in the format
+// sha256sum -c reads, linking the output beside it to its source.
+func write_source_checksum(source string, sum string, dir string) error {
+	name := filepath.Base(source)
+	return os.WriteFile(filepath.Join(dir, normalize_name(name+".sha256")), []byte(sum+"  "+name+"\n"), 0666)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+)
+
+var dsd_codecs = []string{"dsd_lsbf", "dsd_msbf", "dsd_lsbf_planar", "dsd_msbf_planar"}
+
+func is_dsd(stream *Stream) bool {
+	return stream != nil && slices.Contains(dsd_codecs, stream.CodecName)
+}
+
+// dsd_filters converts DSD to PCM: ffmpeg decodes DSD64 to 352.8kHz with
+// the ultrasonic noise intact, which is filtered out before resampling to
+// 88.2kHz. Lossy encoders resample this again themselves.
+func dsd_filters() []string {
+	return []string{"lowpass=f=24000:poles=2", "aresample=88200"}
+}
+
+// detect_hdcd decodes the start of a 16-bit source through the hdcd filter,
+// which reports whether it found the HDCD signalling.
+func detect_hdcd(runctx context.Context, filename string, stream *Stream) bool {
+	if stream == nil || stream.SampleRate != "44100" || (stream.SampleFmt != "s16" && stream.SampleFmt != "s16p") {
+		return false
+	}
+	ffmpeg := exec.CommandContext(runctx, "ffmpeg", "-nostdin", "-hide_banner", "-t", "60", "-i", filename,
+		"-map", "0:a:0", "-af", "hdcd", "-f", "null", "-")
+	out, err := ffmpeg.CombinedOutput()
+	if err != nil {
+		log.Warn("HDCD detection failed", "file", filename, "error", err)
+		return false
+	}
+	return strings.Contains(string(out), "HDCD detected: yes")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// track_state is what --incremental records of a converted track, to tell
+// whether it has changed since.
+type track_state struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+	Preset  string    `json:"preset"`
+	Output  string    `json:"output"`
+}
+
+// incremental_state is the --incremental state file, keyed by source.
+type incremental_state struct {
+	filename string
+	mu       sync.Mutex
+	tracks   map[string]track_state
+	pending  map[string]track_state // fingerprints of the tracks being converted
+	recorded map[string]track_state // converted, but not yet uploaded
+}
+
+var incremental *incremental_state
+
+// load_incremental reads the state file, which is created on the first run.
+func load_incremental(filename string) (*incremental_state, error) {
+	s := &incremental_state{filename: filename, tracks: map[string]track_state{}, pending: map[string]track_state{}, recorded: map[string]track_state{}}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.tracks); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// commit saves the tracks recorded since the last commit, once the album
+// has been delivered. The file is written through a temporary file so an
+// interrupted run can't leave it truncated.
+func (s *incremental_state) commit() error {
+	s.mu.Lock()
+	for key, state := range s.recorded {
+		s.tracks[key] = state
+	}
+	clear(s.recorded)
+	data, err := json.MarshalIndent(s.tracks, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.filename + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+// state_key identifies a job's source across runs: the zip entry or file
+// it came from, and the track of a single file album.
+func state_key(j job) string {
+	source := j.input
+	if j.origin != "" {
+		source = j.origin
+	}
+	if abs, err := filepath.Abs(source); err == nil {
+		source = abs
+	}
+	if j.cue != nil {
+		source += "#" + strconv.Itoa(j.cue.track.number)
+	}
+	return source
+}
+
+// source_state describes a job's source now. Files with the size and
+// modification time recorded before aren't hashed again, but files
+// extracted from zips are always hashed, as they're freshly written.
+func source_state(j job, previous track_state) (track_state, error) {
+	stat, err := os.Stat(j.input)
+	if err != nil {
+		return track_state{}, err
+	}
+	state := track_state{Size: stat.Size(), ModTime: stat.ModTime()}
+	if j.origin == "" && previous.SHA256 != "" && previous.Size == state.Size && previous.ModTime.Equal(state.ModTime) {
+		state.SHA256 = previous.SHA256
+		return state, nil
+	}
+	state.SHA256, err = file_hash(j.input)
+	return state, err
+}
+
+// whole_album reports whether albums have to be converted in full, as
+// their sidecar, playlist, archive or accurate gapless cut covers every
+// track.
+func whole_album(ctx *cli.Context) bool {
+	return ctx.String("sidecar") != "" || ctx.String("playlist") != "" || ctx.Bool("output-archive") || ctx.String("gapless") == "accurate"
+}
+
+// changed_jobs returns the jobs whose source or preset changed since they
+// were recorded, or whose local output has gone.
+func (s *incremental_state) changed_jobs(ctx *cli.Context, jobs []job) []job {
+	var changed []job
+	for _, j := range jobs {
+		t := job_transcoder(ctx, get_transcoder(ctx), j)
+		key := state_key(j)
+		previous, recorded := s.tracks[key]
+		state, err := source_state(j, previous)
+		if err != nil {
+			log.Warn("Failed to fingerprint source", "name", filepath.Base(j.input), "error", err)
+		}
+		state.Preset = t.name
+		if t.command != "" {
+			state.Preset = t.command
+		}
+		s.pending[key] = state
+		unchanged := recorded && err == nil && state.SHA256 == previous.SHA256 && state.Preset == previous.Preset
+		if unchanged && ctx.String("output-dir") != "" {
+			_, err := os.Stat(previous.Output)
+			unchanged = err == nil
+		}
+		if unchanged {
+			log.Debug("Unchanged", "name", filepath.Base(key))
+		} else {
+			changed = append(changed, j)
+		}
+	}
+	if len(changed) > 0 && len(changed) < len(jobs) && whole_album(ctx) {
+		log.Info("🔁 Converting the whole album", "changed", len(changed))
+		return jobs
+	}
+	if len(changed) < len(jobs) {
+		log.Info("⏭ Skipping unchanged tracks", "unchanged", len(jobs)-len(changed), "changed", len(changed))
+	}
+	return changed
+}
+
+// record notes a job converted, to be saved by the next commit.
+func (s *incremental_state) record(j job, c conversion_result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := state_key(j)
+	state := s.pending[key]
+	state.Output = c.output
+	s.recorded[key] = state
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+var inventory_command = &cli.Command{
+	Name:      "inventory",
+	Usage:     "list the albums missing from the --rsync destinations, and those there with no source",
+	ArgsUsage: "SOURCE...",
+	Action:    inventory,
+}
+
+// album_dir is where an album is uploaded to under a destination, as
+// artist/album unless there's an --rsync-template.
+func album_dir(metadata Metadata) (string, error) {
+	if rsync_template != nil {
+		dir, err := template_album_dir(metadata.Format.Tags)
+		return normalize_name(dir), err
+	}
+	return normalize_name(filesafe(join_artists(metadata.Format.Tags.AlbumArtist)) + "/" + filesafe(metadata.Format.Tags.Album)), nil
+}
+
+// first_media_file returns the first audio or video file of those given.
+func first_media_file(filenames []string) string {
+	slices.Sort(filenames)
+	for _, filename := range filenames {
+		if isMediaFile(filename) {
+			return filename
+		}
+	}
+	return ""
+}
+
+// zip_album probes the first track of a zip, extracting only that.
+func zip_album(filename string) (string, error) {
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+	entries := map[string]*zip.File{}
+	var names []string
+	for _, entry := range archive.File {
+		entries[entry.Name] = entry
+		names = append(names, entry.Name)
+	}
+	first := first_media_file(names)
+	if first == "" {
+		return "", fmt.Errorf("no audio files found in %s", filename)
+	}
+	tmpdir, err := os.MkdirTemp("", "audioconvert")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := unzip_entry(entries[first], tmpdir); err != nil {
+		return "", err
+	}
+	metadata, err := get_metadata(filepath.Join(tmpdir, first))
+	if err != nil {
+		return "", err
+	}
+	return album_dir(metadata)
+}
+
+// source_albums returns the album directories the sources would be uploaded
+// to, mapped to the source they come from. Zips are one album, and loose
+// files are grouped by directory, probing the first file of each.
+func source_albums(sources []string) (map[string]string, error) {
+	albums := map[string]string{}
+	for _, source := range sources {
+		stat, err := os.Stat(source)
+		if err != nil {
+			return nil, err
+		}
+		if !stat.IsDir() {
+			if filepath.Ext(source) == ".zip" {
+				album, err := zip_album(source)
+				if err != nil {
+					return nil, err
+				}
+				albums[album] = source
+			} else if isMediaFile(source) {
+				metadata, err := get_metadata(source)
+				if err != nil {
+					return nil, err
+				}
+				album, err := album_dir(metadata)
+				if err != nil {
+					return nil, err
+				}
+				albums[album] = source
+			}
+			continue
+		}
+		dirs := map[string][]string{}
+		var zips []string
+		err = filepath.WalkDir(source, func(filename string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if filepath.Ext(filename) == ".zip" {
+				zips = append(zips, filename)
+			} else if isMediaFile(filename) {
+				dirs[filepath.Dir(filename)] = append(dirs[filepath.Dir(filename)], filename)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range zips {
+			album, err := zip_album(filename)
+			if err != nil {
+				return nil, err
+			}
+			albums[album] = filename
+		}
+		for dir, files := range dirs {
+			metadata, err := get_metadata(first_media_file(files))
+			if err != nil {
+				return nil, err
+			}
+			if metadata.Format.Tags.AlbumArtist == "" && len(files) > 1 {
+				var jobs []job
+				for _, filename := range files {
+					jobs = append(jobs, job{input: filename})
+				}
+				metadata.Format.Tags.AlbumArtist = compilation_artist(probe_all(jobs))
+			}
+			album, err := album_dir(metadata)
+			if err != nil {
+				return nil, err
+			}
+			albums[album] = dir
+		}
+	}
+	return albums, nil
+}
+
+var rsync_list_re = regexp.MustCompile(`^d\S*\s+\S+\s+\S+\s+\S+\s+(.+)$`)
+
+// dest_albums lists the album directories at an rsync destination, which
+// may be remote.
+func dest_albums(dest string) ([]string, error) {
+	depth := album_depth()
+	args := []string{"--list-only", "--recursive"}
+	for i := 1; i <= depth; i++ {
+		args = append(args, "--include=/"+strings.Repeat("*/", i))
+	}
+	args = append(args, "--exclude=*", dest+"/")
+	out, err := exec.Command("rsync", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing %s failed: %w", dest, err)
+	}
+	var albums []string
+	for _, line := range strings.Split(string(out), "\n") {
+		m := rsync_list_re.FindStringSubmatch(line)
+		if m != nil && strings.Count(m[1], "/") == depth-1 {
+			albums = append(albums, m[1])
+		}
+	}
+	slices.Sort(albums)
+	return albums, nil
+}
+
+func inventory(ctx *cli.Context) error {
+	log.SetTimeFormat(time.Kitchen)
+	set_log_level(ctx.String("log-level"))
+	if ctx.NArg() == 0 {
+		log.Fatal("Inventory needs source files or directories")
+	}
+	dests := ctx.StringSlice("rsync")
+	if len(dests) == 0 {
+		log.Fatal("Inventory needs an --rsync destination")
+	}
+	set_naming(ctx)
+	probe_jobs = pool_jobs(ctx)
+	albums, err := source_albums(ctx.Args().Slice())
+	if err != nil {
+		return err
+	}
+	var names []string
+	for album := range albums {
+		names = append(names, album)
+	}
+	slices.Sort(names)
+
+	for _, dest := range dests {
+		existing, err := dest_albums(dest)
+		if err != nil {
+			return err
+		}
+		var missing, orphaned []string
+		for _, album := range names {
+			if !slices.Contains(existing, album) {
+				missing = append(missing, album)
+			}
+		}
+		for _, album := range existing {
+			if _, ok := albums[album]; !ok {
+				orphaned = append(orphaned, album)
+			}
+		}
+		log.Info("📋 Inventory", "destination", dest, "source", len(names), "uploaded", len(existing), "missing", len(missing), "orphaned", len(orphaned))
+		if len(missing) > 0 {
+			fmt.Printf("Missing from %s:\n", dest)
+			for _, album := range missing {
+				fmt.Printf("  %s (%s)\n", album, albums[album])
+			}
+		}
+		if len(orphaned) > 0 {
+			fmt.Printf("Only in %s:\n", dest)
+			for _, album := range orphaned {
+				fmt.Printf("  %s\n", album)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// lrc_timestamp matches the [mm:ss.xx] times of synced lyrics, and the
+// [ar:...] style header tags.
+var lrc_timestamp = regexp.MustCompile(`\[[^\]]*\]`)
+
+// synced_lyrics_extensions are outputs whose lyrics tag can keep LRC
+// timestamps, which players of vorbis comments understand. ID3 USLT and
+// MP4 lyrics are plain text.
+var synced_lyrics_extensions = []string{"flac", "opus", "ogg", "oga"}
+
+func isLyricsFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".lrc")
+}
+
+// track_lyrics reads the .lrc file with the same basename as a track, or
+// returns "" if there isn't one. Timestamps are stripped unless the output
+// format keeps them.
+func track_lyrics(filename string, extension string) string {
+	data, err := os.ReadFile(strings.TrimSuffix(filename, filepath.Ext(filename)) + ".lrc")
+	if err != nil {
+		return ""
+	}
+	lyrics := strings.TrimPrefix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\ufeff")
+	for _, ext := range synced_lyrics_extensions {
+		if strings.HasSuffix(extension, ext) {
+			return strings.TrimSpace(lyrics)
+		}
+	}
+	var lines []string
+	for _, line := range strings.Split(lyrics, "\n") {
+		stripped := strings.TrimSpace(lrc_timestamp.ReplaceAllString(line, ""))
+		if stripped != "" || (line == "" && len(lines) > 0) {
+			lines = append(lines, stripped)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -1,23 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	log "github.com/charmbracelet/log"
+	"github.com/schollz/progressbar/v3"
 	"github.com/urfave/cli/v2"
 )
 
 const poolSize = 8
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func cleanupTmpdir(tmpdir string, msg string) {
 	log.Infof("🗑 Cleaning up %s...", msg)
 	rm_args := []string{"-rf", tmpdir}
@@ -30,7 +44,20 @@ func cleanupTmpdir(tmpdir string, msg string) {
 
 var safechars = regexp.MustCompile(`[^a-zA-Z0-9\(\)\-!'". ]+`)
 
+// control_chars matches newlines, nulls and other control characters,
+// which broken or malicious tags can contain.
+var control_chars = regexp.MustCompile(`[\x00-\x1f\x7f]+`)
+
+// strip_control replaces the control characters in a tag with spaces, so
+// that a title spanning lines stays one line.
+func strip_control(s string) string {
+	return control_chars.ReplaceAllString(s, " ")
+}
+
 func filesafe(s string) string {
+	// space out control characters explicitly, rather than relying on
+	// safechars not to allow them
+	s = strip_control(s)
 	// replace non-alphanumeric characters with underscores
 	s = safechars.ReplaceAllString(s, "_")
 	return s
@@ -38,39 +65,464 @@ func filesafe(s string) string {
 }
 
 func main() {
-	app := &cli.App{
+	if err := new_app().Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// new_app returns the command line app, with its flags and commands.
+func new_app() *cli.App {
+	return &cli.App{
+		Version: version,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "transcoder-command",
 				Value: "",
 				Usage: "transcoder command",
 			},
+			&cli.BoolFlag{
+				Name:  "shell",
+				Usage: "run the transcoder command with bash, for commands that need pipes or other shell features. It reads the file names and tags from $input, $output, $artist, $album_artist, $album, $title and $track in the environment. Without it they are substituted into the arguments as they are",
+			},
+			&cli.BoolFlag{
+				Name:  "validate-command",
+				Usage: "try the transcoder command on a generated sample before converting",
+			},
 			&cli.StringFlag{
 				Name:  "transcoder-preset",
 				Value: "",
-				Usage: "transcoder preset command",
+				Usage: "transcoder preset command, or remux to copy the audio unchanged",
+			},
+			&cli.StringFlag{
+				Name:  "id3-version",
+				Usage: "ID3v2 version of mp3 outputs, 3 for older players such as car stereos, or 4. Defaults to ffmpeg's, 4",
+			},
+			&cli.BoolFlag{
+				Name:  "id3v1",
+				Usage: "also write an ID3v1 tag to mp3 outputs, for players that only read those",
+			},
+			&cli.StringFlag{
+				Name:  "container",
+				Usage: "output container, overriding the preset's, e.g. mp4 for aac or oga for flac. mp4, m4a, m4b, mp3, flac, opus, ogg, oga, mka or wav",
+			},
+			&cli.StringSliceFlag{
+				Name:  "format-fallback",
+				Usage: "presets to try in order when ffmpeg lacks the encoder of --transcoder-preset, e.g. opus,aac,mp3",
+			},
+			&cli.StringSliceFlag{
+				Name:  "preset-alias",
+				Usage: "old=new pairs of preset names, so scripts using old names keep working",
+			},
+			&cli.StringFlag{
+				Name:  "encoder-args",
+				Usage: "extra ffmpeg options for presets, added last before the output so they override the preset's. Split on spaces, with shell style quoting but no expansion",
+			},
+			&cli.StringFlag{
+				Name:  "bitrate-mode",
+				Usage: "rate control for every codec that has it: vbr, cbr or abr (default the preset's own)",
+			},
+			&cli.StringFlag{
+				Name:  "opus-vbr",
+				Value: "on",
+				Usage: "opus rate control: on, off or constrained",
+			},
+			&cli.StringFlag{
+				Name:  "opus-application",
+				Value: "audio",
+				Usage: "opus application: voip, audio or lowdelay",
+			},
+			&cli.Float64Flag{
+				Name:  "sample-seconds",
+				Usage: "only convert a clip of this many seconds from each track, to preview a preset",
+			},
+			&cli.StringFlag{
+				Name:  "sample-start",
+				Value: "middle",
+				Usage: "where sample clips start: middle, or a number of seconds",
+			},
+			&cli.StringFlag{
+				Name:  "normalize-rate",
+				Usage: "resample tracks to a single sample rate across each album: auto for the most common rate, or a rate such as 44100",
+			},
+			&cli.StringFlag{
+				Name:  "channels",
+				Value: "keep",
+				Usage: "output channels: mono, stereo or keep",
+			},
+			&cli.BoolFlag{
+				Name:  "trim-silence",
+				Usage: "trim silence from the start and end of each track. Silences of 2 seconds or more within a track are removed too",
+			},
+			&cli.StringFlag{
+				Name:  "silence-threshold",
+				Value: "-50dB",
+				Usage: "level below which --trim-silence treats audio as silent",
+			},
+			&cli.Float64Flag{
+				Name:  "silence-duration",
+				Usage: "seconds of sound needed to end the silence trimmed, so clicks and noise aren't mistaken for the start of a track",
+			},
+			&cli.StringFlag{
+				Name:  "gapless",
+				Value: "standard",
+				Usage: "gapless mode: standard, or accurate to cut opus tracks from the whole decoded album",
+			},
+			&cli.BoolFlag{
+				Name:  "adaptive",
+				Usage: "choose the opus/aac bitrate from the source channels, sample rate and bit depth",
+			},
+			&cli.StringFlag{
+				Name:  "adaptive-bitrates",
+				Usage: "override adaptive bitrates, e.g. voice=64k,stereo=128k,hires=192k,surround=256k",
+			},
+			&cli.IntFlag{
+				Name:  "limit",
+				Usage: "only convert the first N files of each album, for testing settings",
+			},
+			&cli.StringSliceFlag{
+				Name:  "input-codec",
+				Usage: "only convert inputs with these audio codecs, e.g. flac,alac,wav",
+			},
+			&cli.DurationFlag{
+				Name:  "min-duration",
+				Usage: "skip inputs shorter than this, e.g. 30s",
+			},
+			&cli.DurationFlag{
+				Name:  "max-duration",
+				Usage: "skip inputs longer than this, e.g. 20m",
+			},
+			&cli.StringFlag{
+				Name:  "dedupe",
+				Usage: "skip duplicate inputs, matched by tags (tags and duration) or pcm (decoded audio hash)",
+			},
+			&cli.StringFlag{
+				Name:  "art-name",
+				Value: "cover.jpg",
+				Usage: "filename for the primary artwork",
+			},
+			&cli.StringFlag{
+				Name:  "art-source",
+				Value: "file",
+				Usage: "album cover to use when there's both an image and artwork embedded in the tracks: file, embedded, or largest by resolution. Embedded artwork is used when there's no image",
+			},
+			&cli.IntFlag{
+				Name:  "copy-jobs",
+				Value: 4,
+				Usage: "number of artwork files copied in parallel",
+			},
+			&cli.BoolFlag{
+				Name:  "drop-secondary-art",
+				Usage: "only copy the primary artwork",
+			},
+			&cli.StringFlag{
+				Name:  "art-from-url",
+				Usage: "fetch artwork for albums without any from a URL template, e.g. https://example.com/{{.Artist}}/{{.Album}}.jpg",
+			},
+			&cli.BoolFlag{
+				Name:  "verify-input",
+				Usage: "decode each source before converting, skipping any with errors",
+			},
+			&cli.BoolFlag{
+				Name:  "verify-output",
+				Usage: "decode each output after converting, failing any with errors rather than keeping or uploading it",
+			},
+			&cli.BoolFlag{
+				Name:  "hdcd",
+				Usage: "detect HDCD encoded CD rips and decode them",
+			},
+			&cli.StringFlag{
+				Name:  "encode-comment",
+				Value: "auto",
+				Usage: "comment tag recording how outputs were produced, auto to describe the conversion or empty to disable",
+			},
+			&cli.StringFlag{
+				Name:  "apply-gain",
+				Usage: "bake the source's gain tags into lossy outputs, for players that ignore them: from-tag for the track gain, or from-album-tag for the album gain. ReplayGain is preferred to R128, which levels to -23 LUFS",
+			},
+			&cli.BoolFlag{
+				Name:  "prevent-clipping",
+				Usage: "reduce the gain of sources peaking near 0dBFS, so lossy outputs don't clip",
+			},
+			&cli.BoolFlag{
+				Name:  "no-chapters",
+				Usage: "don't write chapter comments into opus and ogg outputs",
+			},
+			&cli.StringFlag{
+				Name:  "chapters-file",
+				Usage: "file of \"hh:mm:ss.mmm Title\" lines to write as the chapters of a single input, instead of its own",
+			},
+			&cli.BoolFlag{
+				Name:  "lyrics",
+				Usage: "embed the lyrics from .lrc files named after each track",
+			},
+			&cli.BoolFlag{
+				Name:  "fix-tags",
+				Usage: "normalize whitespace, duplicate values, track numbers and encoding of tags in outputs",
+			},
+			&cli.StringFlag{
+				Name:  "preset-map",
+				Usage: "file of \"pattern = preset\" lines choosing the preset for matching files, instead of --transcoder-preset",
+			},
+			&cli.StringFlag{
+				Name:  "artist-separator",
+				Usage: "join the artists of multi-artist tags with this in paths and playlists, e.g. \" and \". The outputs' own tags are written as a single \";\" separated value, as ffmpeg can't write repeated Vorbis or ID3 multi-value tags",
+			},
+			&cli.StringFlag{
+				Name:  "va-name",
+				Value: "Various Artists",
+				Usage: "album artist in paths for compilations without one, whose tracks are by different artists",
+			},
+			&cli.IntFlag{
+				Name:  "probe-retries",
+				Value: 2,
+				Usage: "times to retry probing a file after I/O errors, such as on flaky network mounts",
+			},
+			&cli.StringFlag{
+				Name:  "genre-map",
+				Usage: "file of \"from = to\" lines mapping genres to their canonical form",
+			},
+			&cli.BoolFlag{
+				Name:  "strict-genre",
+				Usage: "drop genres not in the --genre-map",
+			},
+			&cli.BoolFlag{
+				Name:  "source-checksum-sidecar",
+				Usage: "write a <source>.sha256 beside each output, recording the hash of the file it was converted from",
+			},
+			&cli.StringFlag{
+				Name:  "sidecar",
+				Usage: "write an album sidecar: json (metadata.json) or nfo (album.nfo)",
+			},
+			&cli.StringFlag{
+				Name:  "playlist",
+				Usage: "write an album playlist: m3u (latin-1) or m3u8 (UTF-8)",
+			},
+			&cli.BoolFlag{
+				Name:  "bom",
+				Usage: "start UTF-8 playlists and sidecars with a byte order mark, for players that need one",
+			},
+			&cli.StringFlag{
+				Name:  "stream",
+				Usage: "encode the inputs in order as one continuous stream to a file or named pipe (- for stdout)",
+			},
+			&cli.StringFlag{
+				Name:  "stream-events",
+				Usage: "write the start offset and tags of each streamed track as JSON lines",
+			},
+			&cli.StringFlag{
+				Name:  "post-hook",
+				Usage: "command run after each file is converted",
+			},
+			&cli.StringFlag{
+				Name:  "post-album-hook",
+				Usage: "command run once per album with $outputdir",
+			},
+			&cli.BoolFlag{
+				Name:  "hook-fatal",
+				Usage: "abort when a hook fails",
+			},
+			&cli.IntFlag{
+				Name:  "jobs",
+				Value: poolSize,
+				Usage: "number of files to convert in parallel",
+			},
+			&cli.IntFlag{
+				Name:  "per-disk-jobs",
+				Usage: "most conversions reading or writing any one disk at once, within --jobs, for libraries spread over several drives. Albums on different disks are converted at the same time. 0 for no limit",
+			},
+			&cli.BoolFlag{
+				Name:  "adaptive-jobs",
+				Usage: "experimental: adjust the number of parallel conversions for the best throughput",
+			},
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "fail files with missing tags, colliding outputs, empty outputs or a duration mismatch instead of warning",
+			},
+			&cli.IntFlag{
+				Name:  "nice",
+				Usage: "run conversions with this niceness, e.g. 19 for the lowest CPU priority",
+			},
+			&cli.IntFlag{
+				Name:  "cpu-limit",
+				Usage: "best effort cap on CPU use as a percentage of the cores, e.g. 50 for passively cooled machines, by running fewer conversions with one ffmpeg thread each",
+			},
+			&cli.BoolFlag{
+				Name:  "ionice",
+				Usage: "run conversions in the idle IO scheduling class",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run-json",
+				Usage: "print the planned conversions as JSON instead of running them. Tags are still probed with ffprobe unless --numbered",
+			},
+			&cli.BoolFlag{
+				Name:  "estimate",
+				Usage: "print the estimated output size of each album and in total, from the preset bitrate, instead of converting",
+			},
+			&cli.BoolFlag{
+				Name:  "fail-fast",
+				Usage: "stop at the first conversion error",
+			},
+			&cli.StringFlag{
+				Name:  "ffmpeg-loglevel",
+				Value: "info",
+				Usage: "ffmpeg log level: error, warning or info. Warnings are reported even when a conversion succeeds",
+			},
+			&cli.StringFlag{
+				Name:  "progress",
+				Value: "auto",
+				Usage: "show the progress bar: auto when writing to a terminal, always or never. The summary is logged either way",
 			},
 			&cli.StringFlag{
 				Name:  "log-level",
 				Value: "INFO",
 				Usage: "log level",
 			},
+			&cli.StringFlag{
+				Name:  "source",
+				Usage: "also convert the zips and audio files under a remote ssh://[user@]host[:port]/path",
+			},
 			&cli.StringFlag{
 				Name:  "output-dir",
 				Value: "",
 				Usage: "output directory",
 			},
+			&cli.BoolFlag{
+				Name:  "disc-folders",
+				Usage: "put the tracks of multi-disc albums in Disc N folders",
+			},
+			&cli.BoolFlag{
+				Name:  "numbered",
+				Usage: "name outputs 0001, 0002, ... in input order, without reading tags",
+			},
+			&cli.BoolFlag{
+				Name:  "allow-overwrite-source",
+				Usage: "allow outputs to replace their source, which is only removed once the output is complete",
+			},
+			&cli.BoolFlag{
+				Name:  "recompress",
+				Usage: "reconvert FLACs at the highest compression level with the flac preset, reporting the space saved. Use with --allow-overwrite-source to replace them in place",
+			},
+			&cli.IntFlag{
+				Name:  "max-embedded-art",
+				Usage: "drop artwork embedded in FLAC outputs when wider or taller than this in pixels, or 0 to keep any size. Defaults to 1500 with --recompress",
+			},
+			&cli.IntFlag{
+				Name:  "max-filename-len",
+				Value: 255,
+				Usage: "longest output file name in bytes, with long titles truncated to fit",
+			},
+			&cli.BoolFlag{
+				Name:  "per-track-art",
+				Usage: "keep each track's own embedded artwork, as an image named after the track where the output format can't embed it. On by default for various artists compilations",
+			},
+			&cli.BoolFlag{
+				Name:  "skip-artwork",
+				Usage: "don't copy, extract or fetch any artwork",
+			},
+			&cli.BoolFlag{
+				Name:  "artwork-only",
+				Usage: "only copy, extract or fetch artwork into the output and rsync destinations, without converting any audio",
+			},
+			&cli.StringFlag{
+				Name:  "min-ffmpeg-version",
+				Usage: "refuse to run with an ffmpeg older than this release, e.g. 6.1, as encoder defaults change between versions",
+			},
+			&cli.StringFlag{
+				Name:  "require-ffmpeg-version",
+				Usage: "refuse to run unless ffmpeg is this release, e.g. 6.1 for any 6.1.x, for reproducible archives",
+			},
+			&cli.StringFlag{
+				Name:  "tag-from-path",
+				Usage: "fill tags missing from the file and any cue sheet from its path, with a pattern: album-dirs, dated-album-dirs, flat, a template like \"{artist}/{date} - {album}/{track} - {title}\" or a regexp with named groups",
+			},
+			&cli.StringFlag{
+				Name:  "incremental",
+				Usage: "state file recording the converted tracks, so later runs only convert tracks whose source or preset changed, and upload just those. Albums with a sidecar, playlist, archive or accurate gapless are converted whole when any track changed",
+			},
+			&cli.StringFlag{
+				Name:  "min-free-space",
+				Usage: "stop the run before starting a conversion when the temp or output disk has less than this free, like 500MB or 2GB",
+			},
 			&cli.StringFlag{
+				Name:  "max-output-size",
+				Usage: "split tracks whose output is estimated to be larger than this, like 2GB, into parts that fit",
+			},
+			&cli.StringFlag{
+				Name:  "name-template",
+				Usage: "name outputs with a template of their tags, e.g. \"{{.Composer}} - {{.Work}} - {{.Track}} - {{.Title}}\"",
+			},
+			&cli.StringFlag{
+				Name:  "output-naming",
+				Value: "original",
+				Usage: "case of the generated file and directory names: original, or lowercase for libraries synced across case insensitive filesystems",
+			},
+			&cli.BoolFlag{
+				Name:  "per-track-dir",
+				Usage: "put each track in its own directory, named like the track, with a copy of the artwork, as some DJ software expects",
+			},
+			&cli.BoolFlag{
+				Name:  "keep-name",
+				Usage: "name outputs after the source file rather than the track and title tags",
+			},
+			&cli.StringFlag{
+				Name:  "dir-mode",
+				Usage: "octal permissions for output directories (default from umask)",
+			},
+			&cli.StringFlag{
+				Name:  "file-mode",
+				Usage: "octal permissions for output files (default from umask)",
+			},
+			&cli.StringSliceFlag{
 				Name:  "rsync",
-				Usage: "rsync destination",
+				Usage: "rsync destination, which can be repeated to upload to each",
+			},
+			&cli.BoolFlag{
+				Name:  "output-archive",
+				Usage: "package each converted album into an \"Artist - Album.zip\" in the output, holding just the files converted or added for it",
+			},
+			&cli.IntFlag{
+				Name:  "archive-compression",
+				Value: 6,
+				Usage: "deflate level for --output-archive, from 0 to store files uncompressed up to 9",
+			},
+			&cli.BoolFlag{
+				Name:  "archive-clean",
+				Usage: "remove the loose files once archived, so only the zip is uploaded",
+			},
+			&cli.BoolFlag{
+				Name:  "stream-upload",
+				Usage: "upload each file as soon as it is converted",
+			},
+			&cli.StringFlag{
+				Name:  "on-conflict",
+				Value: "overwrite",
+				Usage: "when outputs already exist, locally or at the rsync destination: overwrite, skip or version",
+			},
+			&cli.StringFlag{
+				Name:  "rsync-bwlimit",
+				Usage: "rsync bandwidth limit, e.g. 1.5m",
+			},
+			&cli.BoolFlag{
+				Name:  "rsync-compress",
+				Usage: "compress rsync transfers",
 			},
+			&cli.BoolFlag{
+				Name:  "rsync-partial",
+				Usage: "keep and resume partially transferred files",
+			},
+			&cli.StringFlag{
+				Name:  "rsync-template",
+				Usage: "layout of albums under the rsync destination, from the same fields as --name-template, e.g. \"{{.Genre}}/{{.AlbumArtist}}/{{year .Date}} - {{.Album}}\". Defaults to artist/album",
+			},
+		},
+		Commands: []*cli.Command{
+			benchmark_command,
+			compare_command,
+			doctor_command,
+			inventory_command,
 		},
 		Action: action,
 	}
-
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
-	}
 }
 
 func set_log_level(level string) {
@@ -91,30 +543,241 @@ func set_log_level(level string) {
 func action(ctx *cli.Context) error {
 	log.SetTimeFormat(time.Kitchen)
 	set_log_level(ctx.String("log-level"))
+	if !slices.Contains(dedupe_methods, ctx.String("dedupe")) {
+		log.Fatal("Unknown dedupe method", "method", ctx.String("dedupe"))
+	}
+	if !slices.Contains(art_sources, ctx.String("art-source")) {
+		log.Fatal("Unknown art source", "source", ctx.String("art-source"))
+	}
+	if !slices.Contains(gapless_modes, ctx.String("gapless")) {
+		log.Fatal("Unknown gapless mode", "mode", ctx.String("gapless"))
+	}
+	if level := ctx.Int("archive-compression"); level < 0 || level > 9 {
+		log.Fatal("Archive compression must be from 0 to 9", "level", level)
+	}
+	if ctx.Bool("archive-clean") && ctx.Bool("stream-upload") {
+		log.Fatal("--archive-clean can't be used with --stream-upload, which uploads the loose files")
+	}
+	if ctx.Bool("archive-clean") && ctx.String("output-dir") != "" {
+		log.Fatal("--archive-clean can't be used with --output-dir, which may hold files other than the albums converted")
+	}
+	if ctx.Bool("skip-artwork") && ctx.Bool("artwork-only") {
+		log.Fatal("--skip-artwork and --artwork-only can't be used together")
+	}
+	if ctx.Int("max-filename-len") < 32 {
+		log.Fatal("Maximum file name length is too short", "length", ctx.Int("max-filename-len"))
+	}
+	if !valid_silence_threshold(ctx.String("silence-threshold")) {
+		log.Fatal("Invalid silence threshold, expected a level like -50dB", "threshold", ctx.String("silence-threshold"))
+	}
+	if ctx.Bool("trim-silence") && ctx.String("gapless") == "accurate" {
+		// trimming would reopen the gaps between tracks
+		log.Warn("Silence isn't trimmed from accurate gapless albums")
+	}
+	for _, flag := range []string{"dir-mode", "file-mode"} {
+		if _, ok := parse_mode(ctx.String(flag)); ctx.String(flag) != "" && !ok {
+			log.Fatal("Invalid octal mode", flag, ctx.String(flag))
+		}
+	}
+	if !slices.Contains(conflict_policies, ctx.String("on-conflict")) {
+		log.Fatal("Unknown conflict policy", "policy", ctx.String("on-conflict"))
+	}
+	if !valid_normalize_rate(ctx.String("normalize-rate")) {
+		log.Fatal("Invalid sample rate", "rate", ctx.String("normalize-rate"))
+	}
+	if _, err := split_args(ctx.String("encoder-args")); err != nil {
+		log.Fatal("Invalid encoder args", "error", err)
+	}
+	if !slices.Contains(id3_versions, ctx.String("id3-version")) {
+		log.Fatal("Unknown ID3 version, expected 3 or 4", "version", ctx.String("id3-version"))
+	}
+	if !slices.Contains(progress_modes, ctx.String("progress")) {
+		log.Fatal("Unknown progress mode", "mode", ctx.String("progress"))
+	}
+	if !slices.Contains(apply_gain_modes, ctx.String("apply-gain")) {
+		log.Fatal("Unknown apply gain mode", "mode", ctx.String("apply-gain"))
+	}
+	if !valid_sample_start(ctx.String("sample-start")) {
+		log.Fatal("Invalid sample start", "start", ctx.String("sample-start"))
+	}
+	set_naming(ctx)
+	probe_retries = ctx.Int("probe-retries")
+	watch_pause()
+	if container := output_container(ctx); container != "" && container_codecs[container] == nil {
+		log.Fatal("Unknown container", "container", container)
+	}
+	for _, name := range []string{"min-ffmpeg-version", "require-ffmpeg-version"} {
+		if v := ctx.String(name); v != "" && !version_re.MatchString(v) {
+			log.Fatal("Invalid version, expected a release like 6.1", "flag", name, "version", v)
+		}
+	}
+	if err := check_ffmpeg_version(ctx.String("min-ffmpeg-version"), ctx.String("require-ffmpeg-version")); err != nil {
+		log.Fatal("Unsupported ffmpeg", "error", err)
+	}
+	if pattern := ctx.String("tag-from-path"); pattern != "" {
+		var err error
+		if tag_path_pattern, err = compile_path_pattern(pattern); err != nil {
+			log.Fatal("Invalid --tag-from-path pattern", "error", err)
+		}
+	}
+	if filename := ctx.String("incremental"); filename != "" {
+		var err error
+		if incremental, err = load_incremental(filename); err != nil {
+			log.Fatal("Failed to read the incremental state", "file", filename, "error", err)
+		}
+	}
+	if size := ctx.String("min-free-space"); size != "" {
+		var err error
+		if min_free_space, err = parse_size(size); err != nil {
+			log.Fatal("Invalid minimum free space", "error", err)
+		}
+	}
+	if size := ctx.String("max-output-size"); size != "" {
+		var err error
+		if max_output_size, err = parse_size(size); err != nil || max_output_size == 0 {
+			log.Fatal("Invalid maximum output size", "size", size)
+		}
+	}
+	if filename := ctx.String("chapters-file"); filename != "" {
+		if ctx.NArg() != 1 {
+			log.Fatal("--chapters-file needs a single input")
+		}
+		var err error
+		if file_chapters, err = load_chapters_file(filename); err != nil {
+			log.Fatal("Failed to load chapters", "error", err)
+		}
+	}
+	if filename := ctx.String("genre-map"); filename != "" {
+		var err error
+		if genre_map, err = load_genre_map(filename); err != nil {
+			log.Fatal("Failed to load genre map", "error", err)
+		}
+	} else if ctx.Bool("strict-genre") {
+		log.Fatal("--strict-genre needs a --genre-map")
+	}
+	if filename := ctx.String("preset-map"); filename != "" {
+		var err error
+		if preset_map, err = load_preset_map(filename); err != nil {
+			log.Fatal("Failed to load preset map", "error", err)
+		}
+		for _, r := range preset_map {
+			preset_transcoder(ctx, r.preset)
+		}
+	}
+	if !slices.Contains(ffmpeg_loglevels, ctx.String("ffmpeg-loglevel")) {
+		log.Fatal("Unknown ffmpeg log level", "level", ctx.String("ffmpeg-loglevel"))
+	}
+	if !slices.Contains(sidecar_formats, ctx.String("sidecar")) {
+		log.Fatal("Unknown sidecar format", "format", ctx.String("sidecar"))
+	}
+	if !slices.Contains(playlist_formats, ctx.String("playlist")) {
+		log.Fatal("Unknown playlist format", "format", ctx.String("playlist"))
+	}
 
-	if ctx.NArg() == 0 {
+	if ctx.NArg() == 0 && ctx.String("source") == "" {
 		log.Fatal("No files specified")
 	}
 
+	if ctx.Int("jobs") < 1 {
+		log.Fatal("At least one job is needed", "jobs", ctx.Int("jobs"))
+	}
+	set_priority(ctx)
+	set_cpu_limit(ctx)
+	probe_jobs = pool_jobs(ctx)
+	set_shared_pool(ctx)
+	set_recompress(ctx)
+	if len(ctx.StringSlice("format-fallback")) > 0 && ctx.String("transcoder-command") == "" {
+		select_fallback_preset(ctx)
+	}
+	// check the transcoder options before any file is processed
+	t := get_transcoder(ctx)
+	if t.command != "" && ctx.Bool("validate-command") {
+		if err := trial_command(t); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	defer func() {
+		log_reclaimed(ctx)
+		log_summary(ctx, time.Since(start))
+	}()
+
 	files := ctx.Args().Slice()
 
+	var errs []error
+	var zips []string
 	single_files := []string{}
 	for _, filename := range files {
 		ext := path.Ext(filename)
-		if ext == ".zip" {
-			process_zip(ctx, filename)
-		} else if ext == ".flac" {
+		if ext == ".zip" && ctx.String("stream") != "" {
+			log.Errorf("Archives can't be streamed: %s", filename)
+		} else if ext == ".zip" {
+			zips = append(zips, filename)
+		} else if isMediaFile(filename) {
 			single_files = append(single_files, filename)
 		} else {
 			log.Errorf("Unknown file type: %s", filename)
 		}
 	}
 
+	var albums [][]string
+	for _, filename := range zips {
+		albums = append(albums, []string{filename})
+	}
+	zip_errs, err := convert_albums(ctx, albums, func(album []string) error {
+		return process_zip(ctx, album[0])
+	})
+	if err != nil {
+		return err
+	}
+	errs = append(errs, zip_errs...)
+
+	if source := ctx.String("source"); source != "" {
+		if ctx.String("stream") != "" {
+			log.Fatal("Remote sources can't be streamed")
+		}
+		if err := process_source(ctx, source); err != nil {
+			if stops_run(ctx, err) {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if ctx.String("stream") != "" {
+		if len(single_files) == 0 {
+			log.Fatal("No audio files to stream")
+		}
+		return stream_files(ctx, single_files)
+	}
+
 	if len(single_files) > 0 {
-		process_single_files(ctx, single_files)
+		if err := process_single_files(ctx, single_files); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	return nil
+	if run_summary.empty > 0 && run_summary.found == 0 {
+		log.Fatal("No audio files found")
+	}
+
+	if ctx.Bool("estimate") {
+		fmt.Printf("Total: %d tracks, ~%s\n", estimate_total.tracks, format_size(estimate_total.bytes))
+	}
+
+	if ctx.Bool("dry-run-json") {
+		if err := write_plan(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var audio_extensions = []string{".flac", ".m4a", ".m4b", ".mp3", ".wav", ".dsf", ".dff", ".opus", ".ogg"}
+
+func isAudioFile(filename string) bool {
+	return slices.Contains(audio_extensions, strings.ToLower(filepath.Ext(filename)))
 }
 
 func output_directory(ctx *cli.Context) string {
@@ -127,225 +790,1588 @@ func output_directory(ctx *cli.Context) string {
 			log.Fatal(err)
 		}
 	} else {
-		os.Mkdir(outputdir, 0755)
+		if err := os.MkdirAll(outputdir, 0777); err != nil {
+			log.Fatal("Failed to create output directory", "dir", outputdir, "error", err)
+		}
+		cleanup_partials(outputdir)
 	}
 	return outputdir
 }
 
-func process_single_files(ctx *cli.Context, files []string) {
-	outputdir := output_directory(ctx)
-	run(ctx, files, outputdir)
+// partial_name returns the temporary name an output is written to. The
+// extension is kept so ffmpeg still picks the right muxer.
+func partial_name(output string) string {
+	dir, base := filepath.Split(output)
+	ext := filepath.Ext(base)
+	return filepath.Join(dir, "."+strings.TrimSuffix(base, ext)+".partial"+ext)
 }
 
-func process_zip(ctx *cli.Context, filename string) {
-	// make a temporary directory for unzipped files
-	tmpdir, err := os.MkdirTemp("", "audioconvert")
+// same_file reports whether two paths are the same file, including through
+// links.
+func same_file(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	sa, err := os.Stat(a)
 	if err != nil {
-		log.Fatal(err)
+		return false
 	}
-	defer cleanupTmpdir(tmpdir, "temporary directory")
+	sb, err := os.Stat(b)
+	return err == nil && os.SameFile(sa, sb)
+}
 
-	outputdir := output_directory(ctx)
+// cleaned_partials are the output directories cleaned up in this run.
+var cleaned_partials sync.Map
 
-	// unzip all files into the temporary directory
-	log.Info("🤐 Unzipping", "name", path.Base(filename))
-	unzip_args := []string{"-d", tmpdir, filename}
-	unzip := exec.Command("unzip", unzip_args...)
-	unzip_out, err := unzip.CombinedOutput()
-	if err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			log.Error("Unzip failed", "error", exiterr, "output", string(unzip_out))
-		}
-		log.Fatal(err)
+// cleanup_partials removes partial outputs left by an interrupted run,
+// once for each directory.
+func cleanup_partials(dir string) {
+	if _, done := cleaned_partials.LoadOrStore(dir, true); done {
+		// anything partial now is being written by another album
+		return
 	}
-	log.Debug(string(unzip_out))
+	filepath.WalkDir(dir, func(filename string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		base := d.Name()
+		if strings.HasPrefix(base, ".") && strings.HasSuffix(strings.TrimSuffix(base, filepath.Ext(base)), ".partial") {
+			log.Warn("Removing partial output", "file", filename)
+			os.Remove(filename)
+		}
+		return nil
+	})
+}
 
-	// get all files from the zip
-	files, err := filepath.Glob(tmpdir + "/*")
+// process_single_files converts loose files, grouped into albums by their
+// album artist and album tags so each is uploaded to its own destination.
+func process_single_files(ctx *cli.Context, files []string) error {
+	run_summary.count(&run_summary.found, len(files))
+	errs, err := convert_albums(ctx, album_groups(ctx, files), func(group []string) error {
+		outputdir := output_directory(ctx)
+		before, err := album_snapshot(ctx, outputdir)
+		if err != nil {
+			return err
+		}
+		var jobs []job
+		for _, filename := range group {
+			jobs = append(jobs, job{input: filename, outputdir: outputdir})
+		}
+		return run(ctx, jobs, outputdir, before)
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return errors.Join(errs...)
+}
 
-	// filter out non-audio files
-	var audio_files []string
+// album_groups splits files into albums, in the order they're first seen.
+// Files that can't be probed are left with the untagged ones, to fail when
+// converted, and --numbered files aren't probed at all.
+func album_groups(ctx *cli.Context, files []string) [][]string {
+	if ctx.Bool("numbered") || len(files) == 1 {
+		return [][]string{files}
+	}
+	var groups [][]string
+	albums := map[string]int{}
 	for _, filename := range files {
-		ext := filepath.Ext(filename)
-		if ext == ".flac" {
-			audio_files = append(audio_files, filename)
-		} else if ext == ".jpg" {
-			// move artwork to output directory
-			log.Info("🎨 Copying artwork", "file", filepath.Base(filename))
-			dest := filepath.Join(outputdir, filepath.Base(filename))
-			err := os.Rename(filename, dest)
+		var key string
+		if metadata, err := get_metadata(filename); err == nil {
+			key = metadata.Format.Tags.AlbumArtist + "\x00" + metadata.Format.Tags.Album
+		}
+		if i, ok := albums[key]; ok {
+			groups[i] = append(groups[i], filename)
+		} else {
+			albums[key] = len(groups)
+			groups = append(groups, []string{filename})
+		}
+	}
+	if len(groups) > 1 {
+		log.Info("💽 Grouped files into albums", "files", len(files), "albums", len(groups))
+	}
+	return groups
+}
+
+func process_zip(ctx *cli.Context, filename string) error {
+	// make a temporary directory for unzipped files
+	tmpdir, err := os.MkdirTemp("", "audioconvert")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cleanupTmpdir(tmpdir, "temporary directory")
+
+	// unzip all files into the temporary directory
+	log.Info("🤐 Unzipping", "name", path.Base(filename))
+	failed, err := unzip(filename, tmpdir)
+	if err != nil {
+		log.Error("Unzip failed", "error", err)
+		return err
+	}
+	if failed > 0 {
+		log.Warn("Some entries failed to extract", "failed", failed)
+	}
+
+	// walk the zip contents, grouping audio files by directory, as multi-disc
+	// albums often keep each disc in its own folder
+	discs := map[string][]string{}
+	images := map[string][]string{}
+	err = filepath.WalkDir(tmpdir, func(filename string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		dir, _ := filepath.Rel(tmpdir, filepath.Dir(filename))
+		if isMediaFile(filename) {
+			discs[dir] = append(discs[dir], filename)
+		} else if isImageFile(filename) {
+			images[dir] = append(images[dir], filename)
+		} else if isLyricsFile(filename) || strings.EqualFold(filepath.Ext(filename), ".cue") {
+			// read alongside their track
+		} else {
+			log.Errorf("Unknown file type: %s", filename)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(discs) == 0 {
+		// one empty zip shouldn't stop a run over many
+		log.Warn("No audio files found, skipping", "name", path.Base(filename))
+		run_summary.count(&run_summary.empty, 1)
+		return nil
+	}
+	for _, files := range discs {
+		run_summary.count(&run_summary.found, len(files))
+	}
+	outputdir := output_directory(ctx)
+	before, err := album_snapshot(ctx, outputdir)
+	if err != nil {
+		return err
+	}
+
+	zipname := filename
+	var jobs []job
+	for dir, files := range discs {
+		discdir := outputdir
+		if len(discs) > 1 {
+			discdir = filepath.Join(outputdir, normalize_name(dir))
+			if err := os.MkdirAll(discdir, 0777); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if sheet := single_file_sheet(files); sheet != nil {
+			// one big file and a cue sheet, as albums are often ripped
+			rel, _ := filepath.Rel(tmpdir, files[0])
+			log.Info("💿 Splitting with cue sheet", "name", path.Base(files[0]), "tracks", len(sheet.tracks))
+			jobs = append(jobs, cue_jobs(job{input: files[0], outputdir: discdir, origin: filepath.Join(zipname, rel)}, sheet)...)
+		} else {
+			for _, filename := range files {
+				rel, _ := filepath.Rel(tmpdir, filename)
+				jobs = append(jobs, job{input: filename, outputdir: discdir, origin: filepath.Join(zipname, rel)})
+			}
+		}
+		// copy the artwork from the closest enclosing directory
+		if ctx.Bool("dry-run-json") || ctx.Bool("estimate") || ctx.Bool("skip-artwork") {
+			continue
+		}
+		if err := copy_artwork(ctx, closest_images(images, dir), files[0], discdir); err != nil {
+			log.Fatal("Failed to copy artwork", "error", err)
+		}
+	}
+	// stable, to keep the tracks split from one file in order
+	slices.SortStableFunc(jobs, func(a, b job) int { return strings.Compare(a.input, b.input) })
+
+	return run(ctx, jobs, outputdir, before)
+}
+
+// closest_images returns the images in dir, or failing that the nearest
+// parent directory with any.
+func closest_images(images map[string][]string, dir string) []string {
+	for {
+		if found, ok := images[dir]; ok {
+			return found
+		}
+		if dir == "." {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+var image_extensions = []string{".jpg", ".jpeg", ".png"}
+
+func isImageFile(filename string) bool {
+	return slices.Contains(image_extensions, strings.ToLower(filepath.Ext(filename)))
+}
+
+// copy_buffer_size is large so images are copied in a few reads.
+const copy_buffer_size = 1 << 20
+
+func copy_file(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(out, in, make([]byte, copy_buffer_size)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// run converts an album's jobs into outputdir, with before the
+// album_snapshot of it taken before anything was written for the album.
+func run(ctx *cli.Context, jobs []job, outputdir string, before map[string]time.Time) error {
+	jobs = filter_jobs(ctx, jobs)
+	if limit := ctx.Int("limit"); limit > 0 && len(jobs) > limit {
+		slices.SortFunc(jobs, func(a, b job) int { return strings.Compare(a.input, b.input) })
+		log.Warn("Limit in effect, not all files will be converted", "limit", limit, "files", len(jobs))
+		run_summary.count(&run_summary.skipped, len(jobs)-limit)
+		jobs = jobs[:limit]
+	}
+	if len(jobs) == 0 {
+		log.Warn("No files to convert")
+		return nil
+	}
+	var metadata Metadata
+	var err error
+	if ctx.Bool("numbered") {
+		// untagged files are named in order, without probing
+		number_jobs(jobs)
+	} else {
+		if metadata, err = get_metadata(jobs[0].input); err != nil {
+			return err
+		}
+		log.Info("ℹ️ Metadata", "artist", metadata.Format.Tags.AlbumArtist, "album", metadata.Format.Tags.Album)
+		if stream := audio_stream(metadata); stream != nil {
+			log.Info("🎶 Input", "codec", stream.CodecName, "sample format", stream.SampleFmt, "sample rate", stream.SampleRate, "channels", stream.Channels)
+		}
+		if len(jobs) > 1 && metadata.Format.Tags.AlbumArtist == "" {
+			if artist := compilation_artist(probe_all(jobs)); artist != "" {
+				log.Info("👥 Compilation", "album", metadata.Format.Tags.Album, "album_artist", artist)
+				metadata.Format.Tags.AlbumArtist = artist
+			}
+		}
+		if len(jobs) > 1 {
+			jobs = check_album(ctx, jobs)
+		}
+	}
+	if ctx.Bool("disc-folders") {
+		if jobs, err = disc_folders(jobs, outputdir); err != nil {
+			return err
+		}
+	}
+	if method := ctx.String("dedupe"); method != "" {
+		kept := dedupe(method, jobs)
+		run_summary.count(&run_summary.skipped, len(jobs)-len(kept))
+		jobs = kept
+	}
+	if incremental != nil && !ctx.Bool("artwork-only") {
+		changed := incremental.changed_jobs(ctx, jobs)
+		run_summary.count(&run_summary.skipped, len(jobs)-len(changed))
+		if jobs = changed; len(jobs) == 0 {
+			log.Info("🆗 Album unchanged")
+			if ctx.String("output-dir") == "" {
+				os.RemoveAll(outputdir)
+			}
+			return nil
+		}
+	}
+	jobs = split_large_jobs(ctx, jobs)
+	var dests []string
+	for _, destpath := range ctx.StringSlice("rsync") {
+		dest := destpath
+		if !ctx.Bool("numbered") {
+			dir, err := album_dir(metadata)
 			if err != nil {
-				log.Fatal("Failed to move file", "filename", filename, "error", err)
+				return err
 			}
+			dest += "/" + dir
+		}
+		dests = append(dests, dest)
+	}
+	if ctx.Bool("dry-run-json") {
+		if ctx.String("output-dir") == "" {
+			defer os.RemoveAll(outputdir)
+		}
+		return plan_jobs(ctx, jobs, outputdir, dests)
+	}
+	if ctx.Bool("estimate") {
+		if ctx.String("output-dir") == "" {
+			defer os.RemoveAll(outputdir)
+		}
+		return estimate_jobs(ctx, jobs)
+	}
+	if ctx.Bool("artwork-only") {
+		return artwork_only(ctx, jobs, outputdir, before, dests, metadata.Format.Tags)
+	}
+	// tracks split with a cue sheet are already cut from one continuous file
+	if ctx.String("gapless") == "accurate" && jobs[0].cue == nil {
+		if t := get_transcoder(ctx); t.preset.codec != "libopus" {
+			log.Warn("Accurate gapless needs an opus preset", "preset", t.name)
 		} else {
-			log.Errorf("Unknown file type: %s", filename)
+			tmpdir, err := os.MkdirTemp("", "audioconvert")
+			if err != nil {
+				return err
+			}
+			defer cleanupTmpdir(tmpdir, "gapless album")
+			if jobs, err = prepare_gapless(ctx.Context, jobs, tmpdir); err != nil {
+				return err
+			}
 		}
 	}
-	if len(audio_files) == 0 {
-		log.Fatal("No audio files found")
+	for i := range dests {
+		dests[i] = conflict_dest(ctx, dests[i])
+	}
+	var uploads []*uploader
+	var done func(conversion_result)
+	if ctx.Bool("stream-upload") && len(dests) > 0 {
+		for _, dest := range dests {
+			uploads = append(uploads, start_uploader(ctx, outputdir, dest))
+		}
+		done = func(c conversion_result) {
+			for _, u := range uploads {
+				u.add(c.output)
+			}
+		}
+	}
+
+	log.Info("📀 Transcoding", "count", len(jobs), "channels", ctx.String("channels"))
+	results := batch_convert(ctx, jobs, done)
+	outputs, failures := split_results(results)
+	for _, u := range uploads {
+		if err := u.wait(); err != nil {
+			log.Error("Upload failed", "error", err)
+		}
+	}
+	run_summary.add(results)
+	for _, f := range failures {
+		if stops_run(ctx, f.err) {
+			return f.err
+		}
+	}
+
+	log_album_clips(outputs)
+
+	if url_template := ctx.String("art-from-url"); url_template != "" && len(outputs) > 0 && !ctx.Bool("skip-artwork") {
+		fetch_missing_art(ctx, url_template, outputdir, metadata.Format.Tags)
+	}
+
+	if format := ctx.String("sidecar"); format != "" && len(outputs) > 0 {
+		if err := write_sidecar(format, ctx.Bool("bom"), outputdir, get_transcoder(ctx).name, outputs); err != nil {
+			log.Error("Failed to write sidecar", "error", err)
+		}
+	}
+
+	if format := ctx.String("playlist"); format != "" && len(outputs) > 0 {
+		if err := write_playlist(format, ctx.Bool("bom"), outputdir, outputs); err != nil {
+			log.Error("Failed to write playlist", "error", err)
+		}
+	}
+
+	var files []string
+	if before != nil {
+		if files, err = album_files(outputdir, outputs, before); err != nil {
+			return err
+		}
+	}
+
+	if err := apply_modes(ctx, outputdir, files, before); err != nil {
+		log.Error("Failed to set permissions", "error", err)
+	}
+
+	if ctx.Bool("output-archive") && len(outputs) > 0 {
+		if _, err := write_archive(ctx, outputdir, archive_name(metadata.Format.Tags), files); err != nil {
+			return err
+		}
+		if ctx.Bool("archive-clean") {
+			// the zip is named for the album, so goes in the top of each destination
+			dests = ctx.StringSlice("rsync")
+		}
+	}
+
+	if hook := ctx.String("post-album-hook"); hook != "" {
+		tags := metadata.Format.Tags
+		env := append(os.Environ(), "outputdir="+outputdir, "album_artist="+tags.AlbumArtist, "album="+tags.Album)
+		run_hook(ctx, "post-album-hook", hook, env)
+	}
+
+	if len(dests) > 0 {
+		// rsync tmpdir over to the destinations. With --stream-upload this
+		// only transfers the extras and anything that failed to upload.
+		if err := rsync_all(ctx, outputdir+"/", dests); err != nil {
+			return err
+		}
+		// remove outputs once every destination has them
+		cleanupTmpdir(outputdir, "output directory")
+	} else {
+		log.Info("Output files:", "path", outputdir)
+	}
+
+	if incremental != nil {
+		if err := incremental.commit(); err != nil {
+			log.Error("Failed to save the incremental state", "error", err)
+		}
+	}
+
+	if len(failures) > 0 {
+		for _, f := range failures {
+			log.Error("❌ Failed", "file", f.input, "error", f.err)
+		}
+		return fmt.Errorf("%d of %d files failed to convert", len(failures), len(outputs)+len(failures))
+	}
+	return nil
+}
+
+// rsync_args builds the rsync command line from the --rsync-* options.
+func rsync_args(ctx *cli.Context, src string, dest string) []string {
+	args := []string{"-rv", "--mkpath"}
+	if bwlimit := ctx.String("rsync-bwlimit"); bwlimit != "" {
+		args = append(args, "--bwlimit="+bwlimit)
+	}
+	if ctx.Bool("rsync-compress") {
+		args = append(args, "-z")
+	}
+	if ctx.Bool("rsync-partial") {
+		args = append(args, "--partial", "--append-verify")
+	}
+	if ctx.String("on-conflict") == "skip" {
+		args = append(args, "--ignore-existing")
+	}
+	return append(args, src, dest)
+}
+
+func rsync(ctx *cli.Context, src string, dest string) error {
+	rsync_args := rsync_args(ctx, src, dest)
+	rsync := exec.Command("rsync", rsync_args...)
+	rsync_out, err := rsync.CombinedOutput()
+	if err != nil {
+		log.Error(string(rsync_out))
+		return fmt.Errorf("rsync to %s: %w", dest, err)
 	}
+	log.Debug(string(rsync_out))
+	return nil
+}
 
-	run(ctx, audio_files, outputdir)
+// summary totals the conversions across every album in the run.
+type summary struct {
+	mu                  sync.Mutex // albums on different disks can be converted at once
+	ok, failed, skipped int
+	bytes_in, bytes_out int64
+	found               int // audio files found in the inputs
+	empty               int // inputs skipped as they had no audio files
 }
 
-func run(ctx *cli.Context, files []string, outputdir string) {
-	metadata := get_metadata(files[0])
-	log.Info("ℹ️ Metadata", "artist", metadata.Format.Tags.AlbumArtist, "album", metadata.Format.Tags.Album)
-	for _, stream := range metadata.Streams {
-		if stream.CodecType == "audio" {
-			log.Info("🎶 Input", "codec", stream.CodecName, "sample format", stream.SampleFmt, "sample rate", stream.SampleRate)
-			break
+var run_summary summary
+
+// count adds n to one of the totals.
+func (s *summary) count(total *int, n int) {
+	s.mu.Lock()
+	*total += n
+	s.mu.Unlock()
+}
+
+func (s *summary) add(results []conversion_result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			s.failed++
+		case r.skipped:
+			s.skipped++
+		default:
+			s.ok++
+			s.bytes_in += r.size_in
+			s.bytes_out += r.size_out
 		}
 	}
-	log.Info("📀 Transcoding", "count", len(files))
-	batch_convert(ctx, files, outputdir)
+}
 
-	var destpath = ctx.String("rsync")
-	if destpath != "" {
-		// rsync tmpdir over to destination
-		dest := fmt.Sprintf("%s/%s/%s", destpath, filesafe(metadata.Format.Tags.AlbumArtist), filesafe(metadata.Format.Tags.Album))
-		log.Info("📤 Uploading", "destination", dest)
-		rsync_args := []string{"-rv", "--mkpath", outputdir + "/", dest + "/"}
-		rsync := exec.Command("rsync", rsync_args...)
-		rsync_out, err := rsync.CombinedOutput()
+// log_summary emits the run totals as a single structured event, for log
+// aggregators.
+func log_summary(ctx *cli.Context, duration time.Duration) {
+	s := &run_summary
+	destination := strings.Join(ctx.StringSlice("rsync"), ",")
+	if destination == "" {
+		destination = ctx.String("output-dir")
+	}
+	preset := ctx.String("transcoder-preset")
+	if ctx.String("transcoder-command") != "" {
+		preset = "custom"
+	}
+	log.Info("📊 Summary",
+		"files_total", s.ok+s.failed+s.skipped,
+		"files_ok", s.ok,
+		"files_failed", s.failed,
+		"files_skipped", s.skipped,
+		"inputs_empty", s.empty,
+		"bytes_in", s.bytes_in,
+		"bytes_out", s.bytes_out,
+		"duration", duration.Round(time.Millisecond),
+		"preset", preset,
+		"destination", destination,
+	)
+}
+
+// preset is a built-in ffmpeg encoding recipe. The command line is assembled
+// by transcoder_command so per-file options can be injected.
+type preset struct {
+	codec     string   // ffmpeg audio encoder
+	extension string   // output file extension
+	args      []string // encoder arguments
+}
+
+var transcoder_presets = map[string]preset{
+	"aac":       {"aac", "m4a", []string{"-b:a", "256k", "-movflags", "+faststart"}},
+	"aac-low":   {"aac", "m4a", []string{"-b:a", "96k", "-movflags", "+faststart"}},
+	"aac-high":  {"aac", "m4a", []string{"-b:a", "320k", "-movflags", "+faststart"}},
+	"opus":      {"libopus", "opus", []string{"-vn", "-b:a", "160k"}},
+	"opus-low":  {"libopus", "opus", []string{"-vn", "-b:a", "96k"}},
+	"opus-high": {"libopus", "opus", []string{"-vn", "-b:a", "320k"}},
+	"flac":      {"flac", "flac", []string{"-compression_level", "12"}},
+	"mp3":       {"libmp3lame", "mp3", []string{"-q:a", "2"}},
+	"mp3-low":   {"libmp3lame", "mp3", []string{"-q:a", "5"}},
+	"mp3-high":  {"libmp3lame", "mp3", []string{"-q:a", "0"}},
+	"wav":       {"pcm_s24le", "wav", []string{}},
+	"alac":      {"alac", "m4a", []string{}},
+	"ogg":       {"libvorbis", "ogg", []string{"-q:a", "5"}},
+	"ogg-low":   {"libvorbis", "ogg", []string{"-q:a", "1"}},
+	"ogg-high":  {"libvorbis", "ogg", []string{"-q:a", "10"}},
+}
+
+// remux copies the audio stream unchanged, only rewriting the container,
+// tags and filename.
+var remux_preset = preset{"copy", "", []string{"-c:v", "copy"}}
+
+// container_codecs lists the audio codecs each output container can hold.
+var container_codecs = map[string][]string{
+	"m4a":  {"aac", "alac"},
+	"m4b":  {"aac", "alac"},
+	"mp4":  {"aac", "alac", "mp3"},
+	"mp3":  {"mp3"},
+	"flac": {"flac"},
+	"opus": {"opus"},
+	"ogg":  {"vorbis", "opus", "flac"},
+	"oga":  {"vorbis", "opus", "flac"},
+	"mka":  {"aac", "alac", "mp3", "flac", "opus", "vorbis", "pcm_s16le", "pcm_s24le", "pcm_s32le"},
+	"wav":  {"pcm_s16le", "pcm_s24le", "pcm_s32le"},
+}
+
+// encoder_codecs maps the preset encoders to the codec they produce, where
+// the names differ.
+var encoder_codecs = map[string]string{
+	"libopus":    "opus",
+	"libmp3lame": "mp3",
+	"libvorbis":  "vorbis",
+}
+
+// output_container returns the --container extension, if any.
+func output_container(ctx *cli.Context) string {
+	return strings.TrimPrefix(strings.ToLower(ctx.String("container")), ".")
+}
+
+// container_extension returns the --container to write a preset's codec
+// in, or the preset's own extension without one.
+func container_extension(ctx *cli.Context, p preset) (string, error) {
+	container := output_container(ctx)
+	if container == "" {
+		return p.extension, nil
+	}
+	codecs, ok := container_codecs[container]
+	if !ok {
+		return "", fmt.Errorf("unknown container %s", container)
+	}
+	codec := p.codec
+	if c, ok := encoder_codecs[codec]; ok {
+		codec = c
+	}
+	if !slices.Contains(codecs, codec) {
+		return "", fmt.Errorf("codec %s can't be written to a %s container", codec, container)
+	}
+	return container, nil
+}
+
+// transcoder is either a custom shell command or a built-in preset.
+type transcoder struct {
+	name      string
+	command   string
+	preset    preset
+	extension string
+	adaptive  map[string]string // source class to bitrate, when --adaptive
+	shell     bool              // run the custom command with bash
+}
+
+// adaptive_bitrates are the default targets for --adaptive, by source class:
+//
+//	voice:    mono sources
+//	stereo:   stereo at up to 48kHz and 16 bits
+//	hires:    stereo above 48kHz or 16 bits
+//	surround: more than two channels
+var adaptive_bitrates = map[string]string{
+	"voice":    "64k",
+	"stereo":   "128k",
+	"hires":    "192k",
+	"surround": "256k",
+}
+
+// parse_adaptive_bitrates overrides the defaults with a list such as
+// "voice=48k,hires=256k".
+func parse_adaptive_bitrates(s string) (map[string]string, error) {
+	bitrates := maps.Clone(adaptive_bitrates)
+	if s == "" {
+		return bitrates, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		class, bitrate, ok := strings.Cut(item, "=")
+		if _, known := adaptive_bitrates[class]; !ok || !known {
+			return nil, fmt.Errorf("invalid adaptive bitrate: %s", item)
+		}
+		bitrates[class] = bitrate
+	}
+	return bitrates, nil
+}
+
+// source_class classifies a stream for --adaptive bitrate selection.
+func source_class(stream *Stream) string {
+	if stream == nil {
+		return "stereo"
+	}
+	rate, _ := strconv.Atoi(stream.SampleRate)
+	bits, _ := strconv.Atoi(stream.BitsPerRawSample)
+	switch {
+	case stream.Channels == 1:
+		return "voice"
+	case stream.Channels > 2:
+		return "surround"
+	case rate > 48000 || bits > 16:
+		return "hires"
+	}
+	return "stereo"
+}
+
+// set_arg returns a copy of args with the value of option replaced, or
+// appended if not present.
+func set_arg(args []string, option string, value string) []string {
+	args = slices.Clone(args)
+	if i := slices.Index(args, option); i >= 0 && i+1 < len(args) {
+		args[i+1] = value
+		return args
+	}
+	return append(args, option, value)
+}
+
+var opus_vbr_modes = []string{"on", "off", "constrained"}
+var opus_applications = []string{"voip", "audio", "lowdelay"}
+
+func get_transcoder(ctx *cli.Context) transcoder {
+	command := ctx.String("transcoder-command")
+	if command != "" {
+		if err := validate_command(command, ctx.Bool("shell")); err != nil {
+			log.Fatal(err)
+		}
+		extension := "opus"
+		if container := output_container(ctx); container != "" {
+			extension = container
+		}
+		return transcoder{name: "custom", command: command, extension: extension, shell: ctx.Bool("shell")}
+	}
+	name := ctx.String("transcoder-preset")
+	if name == "" {
+		log.Fatal("No transcoder preset specified")
+	}
+	t := preset_transcoder(ctx, name)
+	if ctx.Bool("adaptive") && t.adaptive == nil {
+		log.Fatal("Adaptive bitrate needs an opus or aac preset", "preset", name)
+	}
+	return t
+}
+
+// preset_transcoder returns the transcoder for a built-in preset.
+func preset_transcoder(ctx *cli.Context, name string) transcoder {
+	name = resolve_preset_alias(ctx, name)
+	if name == "remux" {
+		// the source's codec is checked against --container per file
+		return transcoder{name: name, preset: remux_preset, extension: output_container(ctx)}
+	}
+	p, ok := transcoder_presets[name]
+	if !ok {
+		log.Fatal("Unknown transcoder preset", "preset", name)
+	}
+	if !slices.Contains(channel_modes, ctx.String("channels")) {
+		log.Fatal("Unknown channels mode", "channels", ctx.String("channels"))
+	}
+	if !slices.Contains(bitrate_modes, ctx.String("bitrate-mode")) {
+		log.Fatal("Unknown bitrate mode", "mode", ctx.String("bitrate-mode"))
+	}
+	if !slices.Contains(opus_vbr_modes, ctx.String("opus-vbr")) {
+		log.Fatal("Unknown opus vbr mode", "mode", ctx.String("opus-vbr"))
+	}
+	if !slices.Contains(opus_applications, ctx.String("opus-application")) {
+		log.Fatal("Unknown opus application", "application", ctx.String("opus-application"))
+	}
+	extension, err := container_extension(ctx, p)
+	if err != nil {
+		log.Fatal("Invalid --container", "preset", name, "error", err)
+	}
+	t := transcoder{name: name, preset: p, extension: extension}
+	if ctx.Bool("adaptive") && (p.codec == "libopus" || p.codec == "aac") {
+		bitrates, err := parse_adaptive_bitrates(ctx.String("adaptive-bitrates"))
 		if err != nil {
-			log.Error(string(rsync_out))
 			log.Fatal(err)
 		}
-		log.Debug(string(rsync_out))
-		// remove outputs
-		cleanupTmpdir(outputdir, "output directory")
+		t.adaptive = bitrates
+	}
+	return t
+}
+
+// output_extension returns the extension for converting filename. Remuxing
+// keeps the source container, provided it can hold the source codec.
+func output_extension(t transcoder, filename string, metadata Metadata) (string, error) {
+	if t.name != "remux" {
+		return t.extension, nil
+	}
+	ext := t.extension
+	if ext == "" {
+		ext = strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	}
+	stream := audio_stream(metadata)
+	if stream == nil {
+		return "", fmt.Errorf("no audio stream to remux")
+	}
+	if !slices.Contains(container_codecs[ext], stream.CodecName) {
+		return "", fmt.Errorf("codec %s not supported by container %s", stream.CodecName, ext)
+	}
+	return ext, nil
+}
+
+// opus_args returns the libopus rate control and channel mapping options.
+func opus_args(ctx *cli.Context, stream *Stream) ([]string, []string) {
+	args := []string{"-vbr", ctx.String("opus-vbr"), "-application", ctx.String("opus-application")}
+	var filters []string
+	if stream != nil && stream.Channels > 2 && ctx.String("channels") == "keep" {
+		// surround sources need the vorbis channel mapping family, and
+		// libopus rejects the (side) variants of the common layouts
+		args = append(args, "-mapping_family", "1")
+		if layout, ok := strings.CutSuffix(stream.ChannelLayout, "(side)"); ok {
+			filters = append(filters, "channelmap=channel_layout="+layout)
+		}
+	}
+	return args, filters
+}
+
+var channel_modes = []string{"mono", "stereo", "keep"}
+
+// channel_args returns the options for the --channels output layout.
+func channel_args(ctx *cli.Context, stream *Stream) ([]string, []string) {
+	switch ctx.String("channels") {
+	case "mono":
+		if stream != nil && stream.Channels == 2 {
+			// average rather than sum the channels, so out of phase
+			// content doesn't clip or cancel harshly
+			return nil, []string{"pan=mono|c0=0.5*c0+0.5*c1"}
+		}
+		return []string{"-ac", "1"}, nil
+	case "stereo":
+		return []string{"-ac", "2"}, nil
+	}
+	return nil, nil
+}
+
+// encode_comment returns the provenance comment written to outputs. The
+// default "auto" describes the conversion, and an empty value disables it.
+func encode_comment(ctx *cli.Context, t transcoder) string {
+	comment := ctx.String("encode-comment")
+	if comment == "auto" {
+		comment = fmt.Sprintf("converted by audioconvert %s with preset=%s on %s", version, t.name, time.Now().Format(time.DateOnly))
+	}
+	return comment
+}
+
+// transcoder_command builds the command line for converting a file with
+// the given metadata. The $input and $output arguments are substituted
+// when it's run.
+func transcoder_command(ctx *cli.Context, t transcoder, j job, metadata Metadata) command_line {
+	if t.command != "" {
+		return custom_command(t)
+	}
+	args := []string{"-c:a", t.preset.codec}
+	args = append(args, t.preset.args...)
+	if t.adaptive != nil {
+		class := source_class(audio_stream(metadata))
+		log.Debug("Adaptive bitrate", "file", metadata.Format.Filename, "class", class, "bitrate", t.adaptive[class])
+		args = set_arg(args, "-b:a", t.adaptive[class])
+	}
+	var filters []string
+	stream := audio_stream(metadata)
+	if j.hdcd {
+		filters = append(filters, "hdcd")
+	}
+	if is_dsd(stream) && t.preset.codec != "copy" {
+		filters = append(filters, dsd_filters()...)
+	}
+	if t.preset.codec != "copy" && j.gapless == nil {
+		filters = append(filters, trim_filters(ctx)...)
+	}
+	if t.preset.codec != "copy" {
+		channel_args, channel_filters := channel_args(ctx, stream)
+		args = append(args, channel_args...)
+		filters = append(filters, channel_filters...)
+	}
+	if t.preset.codec == "libopus" {
+		opus_args, opus_filters := opus_args(ctx, stream)
+		args = append(args, opus_args...)
+		filters = append(filters, opus_filters...)
+	}
+	args = bitrate_mode_args(ctx, t.preset.codec, args)
+	if cpu_jobs > 0 {
+		args = append(args, "-threads", "1")
+	}
+	inputs := []string{"-i", "$input"}
+	if j.cue != nil {
+		inputs = append(j.cue.input_args(), inputs...)
+	}
+	if j.part != nil {
+		inputs = append(j.part.input_args(), inputs...)
+	}
+	if isVideoFile(j.input) {
+		if i := best_audio_stream(metadata); i >= 0 {
+			inputs = append(inputs, "-map", "0:"+strconv.Itoa(i))
+		}
+		args = append(args, "-vn")
+	}
+	if j.gapless != nil {
+		// cut the track from the decoded album, taking the tags from the track
+		inputs = append(j.gapless.input_args(), "-i", "$input", "-map", "0:a", "-map_metadata", "1")
+		filters = append([]string{gapless_filter(j.gapless)}, filters...)
+	}
+	if j.sample_rate > 0 && t.preset.codec != "copy" && t.preset.codec != "libopus" {
+		// opus is always 48kHz
+		args = append(args, "-ar", strconv.Itoa(j.sample_rate))
+	}
+	if j.gain != 0 && ctx.String("apply-gain") != "" {
+		// the gain is already applied, so players mustn't apply it again
+		args = append(args, clear_gain_args...)
+	}
+	if j.gain != 0 {
+		filters = append(filters, fmt.Sprintf("volume=%.2fdB", j.gain))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	args = append(args, sample_args(ctx, metadata)...)
+	args = append(args, embedded_art_args(ctx, t, j, metadata)...)
+	args = append(args, tags_args(metadata.Added)...)
+	// remuxing keeps the source's container
+	extension := t.extension
+	if extension == "" {
+		extension = strings.ToLower(strings.TrimPrefix(filepath.Ext(j.input), "."))
+	}
+	args = append(args, muxer_args(ctx, extension)...)
+	if ctx.Bool("lyrics") {
+		if lyrics := track_lyrics(j.input, extension); lyrics != "" {
+			args = append(args, "-metadata", "lyrics="+lyrics)
+		}
+	}
+	if _, _, sampling := sample_window(ctx, metadata); slices.Contains([]string{"opus", "ogg", "oga"}, t.extension) && !ctx.Bool("no-chapters") && !sampling {
+		args = append(args, chapter_args(source_chapters(metadata))...)
+	}
+	if comment := encode_comment(ctx, t); comment != "" {
+		args = append(args, "-metadata", "comment="+comment)
+	}
+	if ctx.Bool("fix-tags") {
+		args = append(args, tag_fix_args(tag_fixes(metadata.Format.Tags))...)
+	}
+	if fix, ok := genre_fix(ctx, metadata.Format.Tags.Genre); ok {
+		args = append(args, tag_fix_args([]tag_fix{fix})...)
+	}
+	// validated up front, so this can't fail
+	extra, _ := split_args(ctx.String("encoder-args"))
+	args = append(args, extra...)
+	command := []string{"ffmpeg", "-nostdin", "-hide_banner", "-nostats", "-loglevel", "level+" + ctx.String("ffmpeg-loglevel"), "-progress", "pipe:1"}
+	command = append(command, inputs...)
+	command = append(command, args...)
+	return command_line{args: append(command, "$output")}
+}
+
+var shellsafe = regexp.MustCompile(`^[a-zA-Z0-9_\-+=:.,/]+$`)
+
+// shell_join quotes args for inclusion in a bash command line.
+func shell_join(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellsafe.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// job is an input file and the directory its output is written to.
+type job struct {
+	input       string
+	outputdir   string
+	gapless     *gapless_segment
+	cue         *cue_segment // the track to cut from a single file album
+	part        *size_part   // the part of a track, from --max-output-size
+	hdcd        bool
+	gain        float64 // dB, from --apply-gain and --prevent-clipping
+	name        string  // output name overriding the tags, from --numbered
+	origin      string  // where the input came from, when extracted from a zip
+	sample_rate int     // resample to, from --normalize-rate
+}
+
+// conversion_result records how a job's conversion went: its output, or
+// the error it failed with.
+type conversion_result struct {
+	input    string
+	output   string
+	preset   string
+	metadata Metadata
+	size_in  int64
+	size_out int64
+	sha256   string // only with a json sidecar
+	duration time.Duration
+	err      error
+	skipped  bool // the output already existed
+}
+
+// split_results separates the conversions that produced an output from
+// the failures.
+func split_results(results []conversion_result) (outputs, failures []conversion_result) {
+	for _, r := range results {
+		if r.err == nil {
+			outputs = append(outputs, r)
+		} else {
+			failures = append(failures, r)
+		}
+	}
+	return outputs, failures
+}
+
+// job_metadata probes the input of a job. Inputs named by --numbered
+// aren't probed, unless they're remuxed into their own container.
+func job_metadata(transcoder transcoder, j job) (Metadata, error) {
+	var metadata Metadata
+	if j.name == "" || transcoder.name == "remux" {
+		var err error
+		if metadata, err = get_metadata(j.input); err != nil {
+			return Metadata{}, err
+		}
 	} else {
-		log.Info("Output files:", "path", outputdir)
+		metadata.Format.Filename = j.input
+	}
+	if isVideoFile(j.input) {
+		video_title(j.input, &metadata)
+	}
+	if j.cue != nil {
+		j.cue.apply(&metadata)
 	}
+	if j.part != nil {
+		j.part.apply(&metadata)
+	}
+	return metadata, nil
 }
 
-var transcoder_presets = map[string]string{
-	"aac":       "ffmpeg -hide_banner -i \"$input\" -c:a aac -b:a 256k -movflags +faststart \"$output\"",
-	"aac-low":   "ffmpeg -hide_banner -i \"$input\" -c:a aac -b:a 96k -movflags +faststart \"$output\"",
-	"aac-high":  "ffmpeg -hide_banner -i \"$input\" -c:a aac -b:a 320k -movflags +faststart \"$output\"",
-	"opus":      "ffmpeg -nostdin -hide_banner -i \"$input\" -vn -c:a libopus -b:a 160k \"$output\"",
-	"opus-low":  "ffmpeg -hide_banner -i \"$input\" -vn -c:a libopus -b:a 96k \"$output\"",
-	"opus-high": "ffmpeg -hide_banner -i \"$input\" -vn -c:a libopus -b:a 320k \"$output\"",
-	"flac":      "ffmpeg -hide_banner -i \"$input\" -c:a flac -compression_level 12 \"$output\"",
-	"mp3":       "ffmpeg -hide_banner -i \"$input\" -c:a libmp3lame -q:a 2 \"$output\"",
-	"mp3-low":   "ffmpeg -hide_banner -i \"$input\" -c:a libmp3lame -q:a 5 \"$output\"",
-	"mp3-high":  "ffmpeg -hide_banner -i \"$input\" -c:a libmp3lame -q:a 0 \"$output\"",
-	"wav":       "ffmpeg -hide_banner -i \"$input\" -c:a pcm_s24le \"$output\"",
-	"alac":      "ffmpeg -hide_banner -i \"$input\" -c:a alac \"$output\"",
-	"ogg":       "ffmpeg -hide_banner -i \"$input\" -c:a libvorbis -q:a 5 \"$output\"",
-	"ogg-low":   "ffmpeg -hide_banner -i \"$input\" -c:a libvorbis -q:a 1 \"$output\"",
-	"ogg-high":  "ffmpeg -hide_banner -i \"$input\" -c:a libvorbis -q:a 10 \"$output\"",
+// output_path returns where a job is converted to, named from its track
+// and title tags by default.
+func output_path(ctx *cli.Context, transcoder transcoder, j job, metadata Metadata) (string, error) {
+	extension, err := output_extension(transcoder, j.input, metadata)
+	if err != nil {
+		return "", err
+	}
+	if _, _, ok := sample_window(ctx, metadata); ok && transcoder.command == "" {
+		extension = "sample." + extension
+	}
+	name := output_name(ctx, j, metadata)
+	// room for partial_name's ".", ".partial" and the extension's ".", and
+	// a version number added by --on-conflict version
+	limit := ctx.Int("max-filename-len") - len("..partial.") - len(extension)
+	if ctx.String("on-conflict") == "version" {
+		limit -= len(" (99)")
+	}
+	if len(name) > limit {
+		truncated := truncate_name(name, limit)
+		log.Info("✂️ Truncated long file name", "name", name, "to", truncated)
+		name = truncated
+	}
+	if ctx.Bool("per-track-dir") {
+		return fmt.Sprintf("%s/%s/%s.%s", j.outputdir, name, name, extension), nil
+	}
+	return fmt.Sprintf("%s/%s.%s", j.outputdir, name, extension), nil
 }
 
-func get_transcoder(ctx *cli.Context) (string, string) {
-	transcoder := ctx.String("transcoder-command")
-	if transcoder == "" {
-		preset := ctx.String("transcoder-preset")
-		if preset == "" {
-			log.Fatal("No transcoder preset specified")
+// truncate_name shortens a file name to at most limit bytes, without
+// splitting a UTF-8 character. The track number at the start is kept.
+func truncate_name(name string, limit int) string {
+	for limit > 0 && !utf8.RuneStart(name[limit]) {
+		limit--
+	}
+	return strings.TrimRight(name[:limit], " .")
+}
+
+// output_name returns the name of a track's output, without extension.
+func output_name(ctx *cli.Context, j job, metadata Metadata) string {
+	name := fmt.Sprintf("%s - %s", track_prefix(metadata.Format.Tags.Track), filesafe(metadata.Format.Tags.Title))
+	if name_template != nil {
+		if named := execute_tags(name_template, metadata.Format.Tags); named != "" {
+			name = named
 		}
-		if _, ok := transcoder_presets[preset]; !ok {
-			log.Fatal("Unknown transcoder preset", "preset", preset)
+	}
+	if ctx.Bool("keep-name") {
+		name = strings.TrimSuffix(filepath.Base(j.input), filepath.Ext(j.input))
+	}
+	if j.name != "" {
+		name = j.name
+	}
+	if j.part != nil && (ctx.Bool("keep-name") || j.name != "") {
+		// otherwise the part is in the title
+		name += fmt.Sprintf(" (part %d)", j.part.number)
+	}
+	return normalize_name(name)
+}
+
+// convert_file converts a job into its output directory, or skips it when
+// the output exists and --on-conflict is skip.
+func convert_file(runctx context.Context, ctx *cli.Context, transcoder transcoder, j job, bar *progressbar.ProgressBar) (conversion_result, error) {
+	filename := j.input
+	done := 0
+	defer func() { bar.Add(100 - done) }()
+
+	if ctx.Bool("verify-input") {
+		if err := verify_input(runctx, filename); err != nil {
+			return conversion_result{}, err
 		}
-		transcoder = transcoder_presets[preset]
 	}
-	return transcoder, "opus"
+	metadata, err := job_metadata(transcoder, j)
+	if err != nil {
+		return conversion_result{}, err
+	}
+	if j.name == "" {
+		if err := check_tags(ctx, filename, metadata.Format.Tags); err != nil {
+			return conversion_result{}, err
+		}
+	}
+	output, err := output_path(ctx, transcoder, j, metadata)
+	if err != nil {
+		return conversion_result{}, err
+	}
+	progress_metadata := metadata
+	if _, length, ok := sample_window(ctx, metadata); ok && transcoder.command == "" {
+		// measure progress against the clip rather than the whole track
+		progress_metadata.Format.Duration = strconv.FormatFloat(length, 'f', 3, 64)
+	}
+	if err := check_collision(ctx, filename, output); err != nil {
+		return conversion_result{}, err
+	}
+	if same_file(filename, output) && !ctx.Bool("allow-overwrite-source") {
+		return conversion_result{}, fmt.Errorf("output would overwrite the source: %s", output)
+	}
+	if stat, err := os.Stat(output); err == nil && !same_file(filename, output) {
+		switch ctx.String("on-conflict") {
+		case "skip":
+			log.Info("⏭ Output exists, skipping", "name", path.Base(output))
+			source, err := os.Stat(filename)
+			if err != nil {
+				return conversion_result{}, err
+			}
+			return conversion_result{input: filename, output: output, preset: transcoder.name, metadata: metadata, size_in: source.Size(), size_out: stat.Size(), sha256: output_hash(ctx, output), skipped: true}, nil
+		case "version":
+			output = versioned_output(output)
+		}
+	}
+	if stream := audio_stream(metadata); transcoder.command == "" && transcoder.preset.codec != "copy" {
+		if is_dsd(stream) && !is_lossless(transcoder.preset.codec) {
+			log.Warn("Converting DSD to a lossy format", "name", path.Base(filename))
+		}
+		if ctx.Bool("hdcd") && detect_hdcd(runctx, filename, stream) {
+			log.Info("💿 HDCD detected", "name", path.Base(filename))
+			j.hdcd = true
+		}
+		if mode := ctx.String("apply-gain"); mode != "" && !is_lossless(transcoder.preset.codec) {
+			if gain, ok := tag_gain(mode, metadata.Format.Tags); ok {
+				log.Info("🔊 Applied gain from tags", "name", path.Base(filename), "gain", fmt.Sprintf("%.2fdB", gain))
+				j.gain = gain
+			} else {
+				log.Warn("No gain tags to apply", "name", path.Base(filename))
+			}
+		}
+		if ctx.Bool("prevent-clipping") && !is_lossless(transcoder.preset.codec) {
+			gain, err := clipping_gain(runctx, filename, j.gain)
+			if err != nil {
+				return conversion_result{}, err
+			}
+			if gain < 0 {
+				log.Info("🔉 Reduced gain to prevent clipping", "name", path.Base(filename), "gain", fmt.Sprintf("%.2fdB", gain))
+				j.gain += gain
+			}
+		}
+	}
+	if ctx.Bool("fix-tags") && transcoder.command == "" {
+		for _, fix := range tag_fixes(metadata.Format.Tags) {
+			log.Info("🧹 Fixed tag", "name", path.Base(filename), "tag", fix.key, "from", fix.from, "to", fix.value)
+		}
+	}
+	genre, mapped := genre_fix(ctx, metadata.Format.Tags.Genre)
+	mapped = mapped && transcoder.command == ""
+	if mapped {
+		log.Info("🏷 Mapped genre", "name", path.Base(filename), "from", genre.from, "to", genre.value)
+	}
+	// MkdirAll is safe when several workers create the same directory
+	if err := os.MkdirAll(filepath.Dir(output), 0777); err != nil {
+		return conversion_result{}, err
+	}
+	// stat the source now, as it may be replaced by the output
+	source, err := os.Stat(filename)
+	if err != nil {
+		return conversion_result{}, err
+	}
+	var source_sum string
+	if ctx.Bool("source-checksum-sidecar") {
+		if source_sum, err = file_hash(filename); err != nil {
+			return conversion_result{}, err
+		}
+	}
+	// write to a partial file and rename into place, so anything at the
+	// output path is complete
+	partial := partial_name(output)
+	err = convert(runctx, transcoder_command(ctx, transcoder, j, metadata), filename, partial, progress_metadata, func(fraction float64) {
+		percent := int(fraction * 100)
+		bar.Add(percent - done)
+		done = percent
+	})
+	if err != nil {
+		os.Remove(partial)
+		return conversion_result{}, err
+	}
+	// verified before the rename, so a broken output never replaces
+	// anything or gets uploaded
+	if ctx.Bool("verify-output") {
+		if err := verify_output(runctx, partial); err != nil {
+			os.Remove(partial)
+			return conversion_result{}, err
+		}
+	}
+	if err := os.Rename(partial, output); err != nil {
+		return conversion_result{}, err
+	}
+	// get size of file
+	stat, err := os.Stat(output)
+	if err != nil {
+		return conversion_result{}, err
+	}
+	if err := check_output(ctx, filename, output, stat.Size(), metadata); err != nil {
+		os.Remove(output)
+		return conversion_result{}, err
+	}
+	log.Info("✅ Transcoded", "name", path.Base(output), "size", stat.Size())
+	if max_output_size > 0 && uint64(stat.Size()) > max_output_size {
+		log.Warn("Output is larger than --max-output-size", "name", path.Base(output), "size", format_size(float64(stat.Size())))
+	}
+	if ctx.Bool("recompress") {
+		log_recompressed(path.Base(output), source.Size(), stat.Size())
+	}
+	if source_sum != "" {
+		if err := write_source_checksum(filename, source_sum, filepath.Dir(output)); err != nil {
+			return conversion_result{}, err
+		}
+	}
+	if ctx.Bool("trim-silence") && transcoder.command == "" {
+		log_trimmed(filename, metadata, output)
+	}
+	if mapped {
+		metadata.Format.Tags.Genre = genre.value
+	}
+	if is_ogg(filename) && !ctx.Bool("skip-artwork") {
+		extract_ogg_art(runctx, ctx, filename, metadata, j.outputdir)
+	}
+	if ctx.Bool("per-track-dir") && !ctx.Bool("skip-artwork") {
+		if err := copy_track_art(j.outputdir, filepath.Dir(output)); err != nil {
+			log.Warn("Failed to copy artwork into the track directory", "name", path.Base(output), "error", err)
+		}
+	}
+	if !ctx.Bool("skip-artwork") {
+		save_track_art(runctx, ctx, filename, metadata, output)
+	}
+	if hook := ctx.String("post-hook"); hook != "" {
+		run_hook(ctx, "post-hook", hook, track_env(filename, output, metadata))
+	}
+	return conversion_result{input: filename, output: output, preset: transcoder.name, metadata: metadata, size_in: source.Size(), size_out: stat.Size(), sha256: output_hash(ctx, output)}, nil
 }
 
-func batch_convert(ctx *cli.Context, files []string, tmpdir string) []string {
-	work_queue := make(chan string)
+// batch_convert converts files using a pool of workers, returning a result
+// for each job that was run. Failures are collected and the remaining files
+// still converted, unless --fail-fast is set, in which case the pool is
+// stopped at the first error.
+func batch_convert(ctx *cli.Context, jobs []job, done func(conversion_result)) []conversion_result {
+	work_queue := make(chan job)
+	runctx, cancel := context.WithCancel(ctx.Context)
+	defer cancel()
 	// create a pool of worker goroutines synchoronized with a workgroup
 	var wg sync.WaitGroup
-	var outputs []string
-	wg.Add(poolSize)
-	transcoder, extension := get_transcoder(ctx)
+	var mu sync.Mutex
+	var results []conversion_result
+	transcoder := get_transcoder(ctx)
+	// each file contributes 100 steps to the bar
+	bar := progressbar.NewOptions(len(jobs)*100,
+		progressbar.OptionSetDescription("Transcoding"),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionClearOnFinish(),
+		// the bars of albums converted at once would overwrite each other
+		progressbar.OptionSetVisibility(show_progress(ctx) && !albums_in_parallel),
+	)
+	defer bar.Finish()
 
-	for i := 0; i < poolSize; i++ {
+	workers := pool_jobs(ctx)
+	limit := new_limiter(workers)
+	if shared_pool.limit != nil {
+		limit = shared_pool.limit
+	}
+	disks := shared_pool.disks
+	var bytes_converted atomic.Int64
+	if ctx.Bool("adaptive-jobs") {
+		// limited from the start, so no more than that run before adapting
+		limit = new_limiter(adaptive_start_jobs)
+		workers = max_adaptive_jobs()
+		go adapt_jobs(runctx, limit, &bytes_converted)
+	}
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
 		go func() {
-			for filename := range work_queue {
-				metadata := get_metadata(filename)
-				// convert track to two digits
-				track := metadata.Format.Tags.Track
-				if len(track) == 1 {
-					track = "0" + track
+			defer wg.Done()
+			for {
+				run_pause.wait(runctx)
+				j, ok := <-work_queue
+				if !ok {
+					return
+				}
+				// the disk slots are taken first, so a job waiting on a
+				// busy disk doesn't hold one of the pool's slots
+				release_disks := func() {}
+				if disks != nil {
+					release_disks = disks.acquire(j)
+				}
+				limit.acquire()
+				if err := check_free_space(os.TempDir(), j.outputdir); err != nil {
+					limit.release()
+					release_disks()
+					mu.Lock()
+					if runctx.Err() == nil {
+						log.Error("💾 Stopping, disk nearly full", "error", err)
+						results = append(results, conversion_result{input: j.input, err: err})
+						cancel()
+					}
+					mu.Unlock()
+					continue
 				}
-				output := fmt.Sprintf("%s/%s - %s.%s", tmpdir, track, filesafe(metadata.Format.Tags.Title), extension)
-				convert(ctx, transcoder, filename, output)
-				outputs = append(outputs, output)
-				// get size of file
-				stat, err := os.Stat(output)
-				if err != nil {
-					log.Fatal(err)
+				start := time.Now()
+				t := job_transcoder(ctx, transcoder, j)
+				output, err := convert_file(runctx, ctx, t, j, bar)
+				limit.release()
+				release_disks()
+				bytes_converted.Add(output.size_in)
+				output.duration = time.Since(start)
+				mu.Lock()
+				if err == nil {
+					results = append(results, output)
+				} else if runctx.Err() == nil {
+					// errors from conversions killed by a cancel aren't reported
+					log.Error("❌ Failed", "name", path.Base(j.input), "error", err)
+					results = append(results, conversion_result{input: j.input, preset: t.name, duration: output.duration, err: err})
+					if ctx.Bool("fail-fast") {
+						cancel()
+					}
+				}
+				mu.Unlock()
+				if err == nil && incremental != nil {
+					incremental.record(j, output)
+				}
+				if err == nil && done != nil {
+					done(output)
 				}
-				log.Info("✅ Transcoded", "name", path.Base(output), "size", stat.Size())
 			}
-			wg.Done()
 		}()
 	}
 
-	for _, filename := range files {
-		work_queue <- filename
+queue:
+	for _, j := range jobs {
+		select {
+		case work_queue <- j:
+		case <-runctx.Done():
+			break queue
+		}
 	}
 
 	close(work_queue)
 	wg.Wait()
 
-	return outputs
+	return results
+}
+
+type Stream struct {
+	CodecName     string `json:"codec_name"`
+	CodecType     string `json:"codec_type"`
+	SampleFmt     string `json:"sample_fmt"`
+	SampleRate    string `json:"sample_rate"`
+	Channels      int    `json:"channels"`
+	ChannelLayout string `json:"channel_layout"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+
+	BitsPerRawSample string `json:"bits_per_raw_sample"`
+	DurationTs       int64  `json:"duration_ts"`
+	TimeBase         string `json:"time_base"`
+
+	Tags Tags
 }
 
 // metadata struct
 type Metadata struct {
-	Streams []struct {
-		CodecName  string `json:"codec_name"`
-		CodecType  string `json:"codec_type"`
-		SampleFmt  string `json:"sample_fmt"`
-		SampleRate string `json:"sample_rate"`
-	}
+	Streams  []Stream
+	Chapters []Chapter
+
+	// tags that weren't in the file, and are written to the output
+	Added Tags `json:"-"`
 
 	Format struct {
 		Filename  string `json:"filename"`
 		NbStreams int    `json:"nb_streams"`
+		Duration  string `json:"duration"`
+		BitRate   string `json:"bit_rate"`
+
+		Tags Tags
+	}
+}
+
+type Tags struct {
+	Album       string `json:"album"`
+	AlbumArtist string `json:"album_artist"`
+	Artist      string `json:"artist"`
+	Title       string `json:"title"`
+	Track       string `json:"track"`
+	Date        string `json:"date"`
+	Genre       string `json:"genre"`
+	Disc        string `json:"disc"`
+
+	// classical works
+	Composer      string `json:"composer"`
+	Work          string `json:"work"`
+	Movement      string `json:"movement"`
+	MovementName  string `json:"movementname"`
+	MovementTotal string `json:"movementtotal"`
 
-		Tags struct {
-			Album       string `json:"album"`
-			AlbumArtist string `json:"album_artist"`
-			Artist      string `json:"artist"`
-			Title       string `json:"title"`
-			Track       string `json:"track"`
+	// loudness, for --apply-gain
+	TrackGain     string `json:"replaygain_track_gain"`
+	TrackPeak     string `json:"replaygain_track_peak"`
+	AlbumGain     string `json:"replaygain_album_gain"`
+	AlbumPeak     string `json:"replaygain_album_peak"`
+	R128TrackGain string `json:"r128_track_gain"`
+	R128AlbumGain string `json:"r128_album_gain"`
+}
+
+// merge_tags fills the fields missing from tags with those from fallback.
+func merge_tags(tags Tags, fallback Tags) Tags {
+	v := reflect.ValueOf(&tags).Elem()
+	f := reflect.ValueOf(fallback)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.String && v.Field(i).String() == "" {
+			v.Field(i).SetString(f.Field(i).String())
 		}
 	}
+	return tags
+}
+
+// audio_stream returns the first audio stream, or nil if there is none.
+func audio_stream(metadata Metadata) *Stream {
+	if i := best_audio_stream(metadata); i >= 0 {
+		return &metadata.Streams[i]
+	}
+	return nil
 }
 
-func get_metadata(filename string) Metadata {
-	ffprobe_args := []string{"-hide_banner", "-i", filename, "-show_format", "-show_streams", "-print_format", "json"}
-	ffprobe := exec.Command("ffprobe", ffprobe_args...)
-	ffprobe_out, err := ffprobe.Output()
+func get_metadata(filename string) (Metadata, error) {
+	ffprobe_out, err := run_ffprobe(filename)
 	if err != nil {
-		log.Fatal(err)
+		return Metadata{}, fmt.Errorf("ffprobe %s: %w", filename, err)
 	}
+	return parse_metadata(filename, ffprobe_out)
+}
 
-	// parse into Metadata struct
+// parse_metadata parses the ffprobe json output for filename, filling in
+// the tags missing from the format from the audio stream, cue sheets and
+// the path.
+func parse_metadata(filename string, ffprobe_out []byte) (Metadata, error) {
 	var metadata Metadata
-	err = json.Unmarshal(ffprobe_out, &metadata)
+	err := json.Unmarshal(ffprobe_out, &metadata)
 	if err != nil {
-		log.Fatal(err)
+		return Metadata{}, fmt.Errorf("ffprobe %s: %w", filename, err)
+	}
+	// some containers (e.g. ogg) carry the tags on the stream
+	if stream := audio_stream(metadata); stream != nil {
+		metadata.Format.Tags = merge_tags(metadata.Format.Tags, stream.Tags)
 	}
+	tags := path_tags(filename, sheet_tags(filename, metadata.Format.Tags))
+	metadata.Added = added_tags(metadata.Format.Tags, tags)
+	metadata.Format.Tags = tags
 
-	return metadata
+	return metadata, nil
 }
 
-func convert(ctx *cli.Context, transcoder string, input string, output string) {
-	cmd := exec.Command("bash", "-c", transcoder)
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "input="+input, "output="+output)
-	log.Debug("Running transcoder", "command", transcoder, "input", input, "output", output)
+// track_var_names are the placeholders available to custom transcoder
+// commands and hooks.
+var track_var_names = []string{"input", "output", "artist", "album_artist", "album", "title", "track"}
+
+// track_vars returns the values of the placeholders for a track.
+func track_vars(input string, output string, metadata Metadata) map[string]string {
+	tags := metadata.Format.Tags
+	return map[string]string{
+		"input":        input,
+		"output":       output,
+		"artist":       tags.Artist,
+		"album_artist": tags.AlbumArtist,
+		"album":        tags.Album,
+		"title":        tags.Title,
+		"track":        tags.Track,
+	}
+}
+
+// track_env returns the placeholders as environment variables, for shell
+// commands and hooks.
+func track_env(input string, output string, metadata Metadata) []string {
+	vars := track_vars(input, output, metadata)
+	env := os.Environ()
+	for _, name := range track_var_names {
+		env = append(env, name+"="+vars[name])
+	}
+	return env
+}
+
+// run_hook runs a user supplied command. Failures are logged, and only
+// abort the run with --hook-fatal.
+func run_hook(ctx *cli.Context, name string, command string, env []string) {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Env = env
+	log.Debug("Running hook", "hook", name, "command", command)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Error("Error", "error", err, "output", string(out))
-		log.Fatal(err)
+		log.Error("Hook failed", "hook", name, "error", err, "output", string(out))
+		if ctx.Bool("hook-fatal") {
+			log.Fatal(err)
+		}
+		return
 	}
+	log.Debug(string(out))
+}
+
+// tail keeps the last few lines written by a process, so errors can be
+// reported without dumping the entire output.
+type tail struct {
+	lines []string
+	next  int
+	full  bool
+}
+
+func new_tail(n int) *tail {
+	return &tail{lines: make([]string, n)}
+}
+
+func (t *tail) add(line string) {
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+func (t *tail) String() string {
+	if !t.full {
+		return strings.Join(t.lines[:t.next], "\n")
+	}
+	return strings.Join(append(t.lines[t.next:], t.lines[:t.next]...), "\n")
+}
+
+const tailLines = 20
+
+// max_line_length is the longest line read from a transcoder's output.
+const max_line_length = 1 << 20
+
+// scan_lines calls line for each line read from r, then discards the rest,
+// so the process writing it never blocks on a full pipe. It returns the
+// error that stopped the scan, such as a line longer than max_line_length.
+func scan_lines(r io.Reader, line func(string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, max_line_length)
+	for scanner.Scan() {
+		line(scanner.Text())
+	}
+	err := scanner.Err()
+	io.Copy(io.Discard, r)
+	return err
+}
+
+// convert runs the transcoder, reporting the fraction of the input
+// converted so far to progress as ffmpeg writes -progress updates.
+func convert(runctx context.Context, transcoder command_line, input string, output string, metadata Metadata, progress func(float64)) error {
+	resolved := transcoder.resolve(track_vars(input, output, metadata))
+	args := priority_command(resolved[0], resolved[1:]...)
+	cmd := exec.CommandContext(runctx, args[0], args[1:]...)
+	cmd.Env = track_env(input, output, metadata)
+	log.Debug("Running transcoder", "command", transcoder, "input", input, "output", output)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	output_tail := new_tail(tailLines)
+	var warnings []string
+	var stderr_err error
+	done := make(chan struct{})
+	go func() {
+		stderr_err = scan_lines(stderr, func(line string) {
+			output_tail.add(line)
+			if msg, ok := ffmpeg_warning(line); ok && len(warnings) < max_ffmpeg_warnings && !slices.Contains(warnings, msg) {
+				warnings = append(warnings, msg)
+			}
+		})
+		close(done)
+	}()
+
+	duration, _ := strconv.ParseFloat(metadata.Format.Duration, 64)
+	stdout_err := scan_lines(stdout, func(line string) {
+		value, ok := strings.CutPrefix(line, "out_time_us=")
+		if !ok || duration <= 0 {
+			return
+		}
+		if us, err := strconv.ParseFloat(value, 64); err == nil {
+			progress(max(0, min(us/1e6/duration, 1)))
+		}
+	})
+	<-done
+	if err := errors.Join(stdout_err, stderr_err); err != nil {
+		log.Warn("Failed to read the transcoder's output", "name", path.Base(input), "error", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		log.Error("Error", "error", err, "output", output_tail.String())
+		return err
+	}
+	for _, msg := range warnings {
+		log.Warn("ffmpeg warning", "name", path.Base(input), "message", msg)
+	}
+	return nil
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func read_fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseMetadataFormatTags(t *testing.T) {
+	metadata, err := parse_metadata("01 - Intro.flac", read_fixture(t, "ffprobe_format_tags.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Tags{Album: "Format Album", AlbumArtist: "Format Artist", Artist: "Format Artist", Title: "Intro", Track: "1/12", Date: "1999"}
+	if metadata.Format.Tags != want {
+		t.Errorf("tags = %+v, want %+v", metadata.Format.Tags, want)
+	}
+	if stream := audio_stream(metadata); stream == nil || stream.CodecName != "flac" {
+		t.Errorf("audio stream = %+v, want flac", stream)
+	}
+}
+
+func TestParseMetadataStreamTags(t *testing.T) {
+	metadata, err := parse_metadata("07 - Stream Title.opus", read_fixture(t, "ffprobe_stream_tags.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the format's own tags win, with the rest taken from the stream
+	want := Tags{Album: "Stream Album", Artist: "Stream Artist", Title: "Format Title", Track: "7", Date: "2004"}
+	if metadata.Format.Tags != want {
+		t.Errorf("tags = %+v, want %+v", metadata.Format.Tags, want)
+	}
+}
+
+func TestParseMetadataInvalid(t *testing.T) {
+	if _, err := parse_metadata("broken.flac", []byte("{")); err == nil {
+		t.Error("expected an error for truncated json")
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "track.flac")
+	other := filepath.Join(dir, "other.flac")
+	for _, filename := range []string{input, other} {
+		if err := os.WriteFile(filename, []byte("fLaC"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "link.flac")
+	if err := os.Symlink(input, link); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"output is the input", input, input, true},
+		{"unclean path", input, filepath.Join(dir, ".", "sub", "..", "track.flac"), true},
+		{"through a link", input, link, true},
+		{"different file", input, other, false},
+		{"output not written yet", input, filepath.Join(dir, "track.opus"), false},
+	}
+	for _, tt := range tests {
+		if got := same_file(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: same_file(%q, %q) = %v, want %v", tt.name, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestStripControl(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Intro", "Intro"},
+		{"Line one\nLine two", "Line one Line two"},
+		{"Null\x00byte", "Null byte"},
+		{"Windows\r\nending", "Windows ending"},
+		{"Tab\tand\x7fdelete", "Tab and delete"},
+	}
+	for _, tt := range tests {
+		if got := strip_control(tt.in); got != tt.want {
+			t.Errorf("strip_control(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFilesafe(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Don't Stop (Remix)", "Don't Stop (Remix)"},
+		{"AC/DC", "AC_DC"},
+		{"Line one\nLine two", "Line one Line two"},
+		{"Null\x00byte", "Null byte"},
+		{"../../etc\x00/passwd", ".._.._etc _passwd"},
+		{"Björk", "Bj_rk"},
+	}
+	for _, tt := range tests {
+		if got := filesafe(tt.in); got != tt.want {
+			t.Errorf("filesafe(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// fake_ffprobe describes every input as a ten second FLAC titled from its
+// name, on the album named by its directory, and fails to probe inputs
+// named broken.
+const fake_ffprobe = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	[ "$1" = -i ] && input=$2
+	shift
+done
+case "$input" in
+*broken*) echo "$input: Invalid data found when processing input" >&2; exit 1 ;;
+esac
+name=$(basename "$input")
+name=${name%.*}
+album=$(basename "$(dirname "$input")")
+cat <<EOF
+{"streams": [{"codec_name": "flac", "codec_type": "audio", "sample_rate": "44100", "channels": 2}],
+ "format": {"filename": "$input", "duration": "10.000000",
+  "tags": {"title": "$name", "track": "1", "artist": "Artist", "album": "$album"}}}
+EOF
+`
+
+// fake_ffmpeg writes its last argument, the output.
+const fake_ffmpeg = `#!/bin/sh
+for arg; do output=$arg; done
+echo converted > "$output"
+`
+
+// fake_tools puts fake_ffprobe and fake_ffmpeg first on the PATH.
+func fake_tools(t *testing.T) {
+	t.Helper()
+	bin := t.TempDir()
+	for name, script := range map[string]string{"ffprobe": fake_ffprobe, "ffmpeg": fake_ffmpeg} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// run_app runs the app with args, calling action with its context instead
+// of converting.
+func run_app(t *testing.T, args []string, action func(ctx *cli.Context)) {
+	t.Helper()
+	app := new_app()
+	app.Action = func(ctx *cli.Context) error {
+		action(ctx)
+		return nil
+	}
+	if err := app.Run(append([]string{"audioconvert"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchConvert(t *testing.T) {
+	fake_tools(t)
+	dir := t.TempDir()
+	outputdir := filepath.Join(dir, "out")
+	var jobs []job
+	for _, name := range []string{"ok.flac", "broken.flac", "skipped.flac"} {
+		input := filepath.Join(dir, name)
+		if err := os.WriteFile(input, []byte("fLaC"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job{input: input, outputdir: outputdir})
+	}
+	if err := os.MkdirAll(outputdir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(outputdir, "01 - skipped.opus")
+	if err := os.WriteFile(existing, []byte("already converted"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []conversion_result
+	run_app(t, []string{"--transcoder-preset", "opus", "--on-conflict", "skip", "--skip-artwork", "--progress", "never", "--jobs", "2"}, func(ctx *cli.Context) {
+		results = batch_convert(ctx, jobs, nil)
+	})
+	if len(results) != len(jobs) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(jobs), results)
+	}
+	slices.SortFunc(results, func(a, b conversion_result) int { return strings.Compare(a.input, b.input) })
+	broken, ok, skipped := results[0], results[1], results[2]
+
+	if ok.err != nil || ok.skipped || ok.output != filepath.Join(outputdir, "01 - ok.opus") || ok.preset != "opus" {
+		t.Errorf("ok result = %+v", ok)
+	}
+	if data, err := os.ReadFile(ok.output); err != nil || string(data) != "converted\n" {
+		t.Errorf("ok output = %q, %v", data, err)
+	}
+	if ok.size_in != 4 || ok.size_out != int64(len("converted\n")) {
+		t.Errorf("ok sizes = %d, %d", ok.size_in, ok.size_out)
+	}
+	if _, err := os.Stat(partial_name(ok.output)); !os.IsNotExist(err) {
+		t.Errorf("partial output left behind: %v", err)
+	}
+
+	if broken.err == nil || !strings.Contains(broken.err.Error(), "Invalid data") || broken.output != "" {
+		t.Errorf("broken result = %+v", broken)
+	}
+
+	if skipped.err != nil || !skipped.skipped || skipped.output != existing || skipped.size_out != int64(len("already converted")) {
+		t.Errorf("skipped result = %+v", skipped)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "already converted" {
+		t.Errorf("skipped output was overwritten: %q", data)
+	}
+
+	outputs, failures := split_results(results)
+	if len(outputs) != 2 || len(failures) != 1 {
+		t.Errorf("split_results = %d outputs, %d failures, want 2 and 1", len(outputs), len(failures))
+	}
+}
+
+func TestConvertLongLines(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "out.opus")
+	// a line within max_line_length, then ones past it on both pipes, with
+	// more written after than a pipe holds
+	script := `long() { head -c "$1" /dev/zero | tr '\0' x; echo; }
+long 200000; echo out_time_us=5000000
+long 2000000 >&2; long 2000000; long 200000 >&2; long 200000
+echo converted > "$output"`
+	c := command_line{args: []string{"sh", "-c", script}}
+	var metadata Metadata
+	metadata.Format.Duration = "10"
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var progress []float64
+	if err := convert(ctx, c, filepath.Join(dir, "in.flac"), output, metadata, func(f float64) { progress = append(progress, f) }); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("convert hung on long lines")
+	}
+	if len(progress) != 1 || progress[0] != 0.5 {
+		t.Errorf("progress = %v, want [0.5]", progress)
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Directories and files are created with 0777 and 0666, so the umask
+// decides their permissions unless --dir-mode or --file-mode are given.
+
+func parse_mode(s string) (os.FileMode, bool) {
+	if s == "" {
+		return 0, false
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, false
+	}
+	perm := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		perm |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		perm |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		perm |= os.ModeSticky
+	}
+	return perm, true
+}
+
+// apply_modes sets the --file-mode permissions on an album's files, from
+// album_files, and the --dir-mode on the directories created for them,
+// those that weren't in the album_snapshot before. Anything already in
+// --output-dir is left alone, while a temporary outputdir was created for
+// the album.
+func apply_modes(ctx *cli.Context, outputdir string, files []string, before map[string]time.Time) error {
+	dir_mode, set_dirs := parse_mode(ctx.String("dir-mode"))
+	file_mode, set_files := parse_mode(ctx.String("file-mode"))
+	outputdir = filepath.Clean(outputdir)
+	dirs := map[string]bool{}
+	if ctx.String("output-dir") == "" {
+		dirs[outputdir] = true
+	}
+	for _, filename := range files {
+		if set_files {
+			if err := os.Chmod(filename, file_mode); err != nil {
+				return err
+			}
+		}
+		for dir := filepath.Dir(filename); dir != outputdir && len(dir) > len(outputdir); dir = filepath.Dir(dir) {
+			if _, ok := before[dir]; !ok {
+				dirs[dir] = true
+			}
+		}
+	}
+	if !set_dirs {
+		return nil
+	}
+	for dir := range dirs {
+		if err := os.Chmod(dir, dir_mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
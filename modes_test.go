@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestApplyModesSharedOutputDir(t *testing.T) {
+	fake_tools(t)
+	dir := t.TempDir()
+	library := filepath.Join(dir, "library")
+	existing_dir := filepath.Join(library, "Old Album")
+	if err := os.MkdirAll(existing_dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(existing_dir, "01 - old.opus")
+	if err := os.WriteFile(existing, []byte("mine"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(library, 0700); err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "New Album", "a.flac")
+	if err := os.MkdirAll(filepath.Dir(input), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(input, []byte("fLaC"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	run_app(t, []string{"--transcoder-preset", "opus", "--output-dir", library, "--per-track-dir", "--dir-mode", "0750", "--file-mode", "0640", "--skip-artwork", "--progress", "never"}, func(ctx *cli.Context) {
+		err = process_single_files(ctx, []string{input})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want os.FileMode
+	}{
+		{library, 0700},
+		{existing_dir, 0700},
+		{existing, 0600},
+		{filepath.Join(library, "01 - a"), 0750},
+		{filepath.Join(library, "01 - a", "01 - a.opus"), 0640},
+	}
+	for _, tt := range tests {
+		info, err := os.Stat(tt.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := info.Mode().Perm(); got != tt.want {
+			t.Errorf("%s mode = %o, want %o", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+var id3_versions = []string{"", "3", "4"}
+
+// muxer_args returns the container options for an output extension, added
+// whatever the preset:
+//
+//	mp3: --id3-version sets the ID3v2 version, and --id3v1 adds an ID3v1 tag
+//
+// Other containers take no extra options. m4a presets already move the
+// index to the start with +faststart.
+func muxer_args(ctx *cli.Context, extension string) []string {
+	var args []string
+	switch extension {
+	case "mp3":
+		if version := ctx.String("id3-version"); version != "" {
+			args = append(args, "-id3v2_version", version)
+		}
+		if ctx.Bool("id3v1") {
+			args = append(args, "-write_id3v1", "1")
+		}
+	}
+	return args
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"text/template"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// output_namings are the --output-naming normalizations of the names
+// audioconvert generates.
+var output_namings = []string{"original", "lowercase"}
+
+// output_naming is the --output-naming in effect.
+var output_naming = "original"
+
+// name_template names outputs from their tags, from --name-template.
+var name_template *template.Template
+
+// rsync_template is the layout of albums under an rsync destination, from
+// --rsync-template.
+var rsync_template *template.Template
+
+var template_funcs = template.FuncMap{
+	"year": func(date string) string { return date[:min(4, len(date))] },
+}
+
+// parse_tags_template parses a template of tags, checking it runs against
+// empty tags so unknown fields are reported before converting.
+func parse_tags_template(text string) (*template.Template, error) {
+	tmpl, err := template.New("tags").Funcs(template_funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(new(bytes.Buffer), Tags{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// execute_tags runs a template on a track's tags. Every field is made file
+// safe, with artists joined and the track number padded as in the default
+// names.
+func execute_tags(tmpl *template.Template, tags Tags) string {
+	track := track_prefix(tags.Track)
+	tags.Artist, tags.AlbumArtist = join_artists(tags.Artist), join_artists(tags.AlbumArtist)
+	v := reflect.ValueOf(&tags).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		v.Field(i).SetString(filesafe(v.Field(i).String()))
+	}
+	tags.Track = track
+	var out bytes.Buffer
+	// the template ran against empty tags when parsed, so it can't fail
+	tmpl.Execute(&out, tags)
+	return strings.TrimSpace(out.String())
+}
+
+// template_album_dir runs the --rsync-template on an album's tags. Each
+// directory it expands to has to be non-empty.
+func template_album_dir(tags Tags) (string, error) {
+	dirs := strings.Split(execute_tags(rsync_template, tags), "/")
+	for i, dir := range dirs {
+		if dirs[i] = strings.TrimSpace(dir); dirs[i] == "" {
+			return "", fmt.Errorf("--rsync-template directory %d is empty for %s - %s", i+1, tags.AlbumArtist, tags.Album)
+		}
+	}
+	return strings.Join(dirs, "/"), nil
+}
+
+// album_depth is the number of directories of an album under a
+// destination.
+func album_depth() int {
+	if rsync_template == nil {
+		return 2
+	}
+	return strings.Count(execute_tags(rsync_template, Tags{}), "/") + 1
+}
+
+// set_naming sets up the naming of outputs and uploaded albums from the
+// flags, shared by converting and the inventory.
+func set_naming(ctx *cli.Context) {
+	artist_separator = ctx.String("artist-separator")
+	if va_name = strings.TrimSpace(ctx.String("va-name")); va_name == "" {
+		log.Fatal("--va-name can't be empty")
+	}
+	if output_naming = ctx.String("output-naming"); !slices.Contains(output_namings, output_naming) {
+		log.Fatal("Unknown output naming", "naming", output_naming)
+	}
+	if text := ctx.String("name-template"); text != "" {
+		var err error
+		if name_template, err = parse_tags_template(text); err != nil {
+			log.Fatal("Invalid name template", "error", err)
+		}
+	}
+	if text := ctx.String("rsync-template"); text != "" {
+		var err error
+		if rsync_template, err = parse_tags_template(text); err != nil {
+			log.Fatal("Invalid rsync template", "error", err)
+		}
+	}
+}
+
+// normalize_name applies --output-naming to a generated file or directory
+// name, so a library synced between case sensitive and insensitive
+// filesystems has the same layout on both. It's applied last, to the name
+// as otherwise generated.
+func normalize_name(name string) string {
+	if output_naming == "lowercase" {
+		return strings.ToLower(name)
+	}
+	return name
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"text/template"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseMetadataClassical(t *testing.T) {
+	metadata, err := parse_metadata("03 - Allegro.flac", read_fixture(t, "ffprobe_classical.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := metadata.Format.Tags
+	if tags.Composer != "Pyotr Ilyich Tchaikovsky" || tags.Work != "Piano Concerto No. 1 in B-flat minor, Op. 23" {
+		t.Errorf("composer, work = %q, %q", tags.Composer, tags.Work)
+	}
+	if tags.Movement != "3" || tags.MovementName != "Allegro con fuoco" || tags.MovementTotal != "3" {
+		t.Errorf("movement = %q, %q of %q", tags.Movement, tags.MovementName, tags.MovementTotal)
+	}
+}
+
+func TestParseTagsTemplate(t *testing.T) {
+	for _, text := range []string{"{{.Composer}} - {{.Title}}", "{{year .Date}}/{{.Album}}", "plain"} {
+		if _, err := parse_tags_template(text); err != nil {
+			t.Errorf("parse_tags_template(%q): %v", text, err)
+		}
+	}
+	for _, text := range []string{"{{.Composr}}", "{{.Title", "{{nofunc .Title}}"} {
+		if _, err := parse_tags_template(text); err == nil {
+			t.Errorf("parse_tags_template(%q) = nil error, want one", text)
+		}
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	defer func(tmpl *template.Template) { name_template = tmpl }(name_template)
+	metadata, err := parse_metadata("03 - Allegro.flac", read_fixture(t, "ffprobe_classical.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.Bool("keep-name", false, "")
+	ctx := cli.NewContext(nil, set, nil)
+
+	name_template = nil
+	if got, want := output_name(ctx, job{}, metadata), "03 - Piano Concerto No. 1_ III. Allegro con fuoco"; got != want {
+		t.Errorf("default name = %q, want %q", got, want)
+	}
+
+	if name_template, err = parse_tags_template("{{.Composer}} - {{.Work}} - {{.Track}} - {{.MovementName}}"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := output_name(ctx, job{}, metadata), "Pyotr Ilyich Tchaikovsky - Piano Concerto No. 1 in B-flat minor_ Op. 23 - 03 - Allegro con fuoco"; got != want {
+		t.Errorf("templated name = %q, want %q", got, want)
+	}
+
+	// tracks without the tags keep the default name
+	if name_template, err = parse_tags_template("{{.Composer}}"); err != nil {
+		t.Fatal(err)
+	}
+	metadata.Format.Tags.Composer = ""
+	if got, want := output_name(ctx, job{}, metadata), "03 - Piano Concerto No. 1_ III. Allegro con fuoco"; got != want {
+		t.Errorf("name without a composer = %q, want %q", got, want)
+	}
+}
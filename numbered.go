@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// number_jobs names outputs by their position in the input order for
+// --numbered, padding to the width of the largest number.
+func number_jobs(jobs []job) {
+	width := len(strconv.Itoa(len(jobs)))
+	for i := range jobs {
+		jobs[i].name = fmt.Sprintf("%0*d", width, i+1)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// picture_extensions maps the codecs of embedded pictures to image file
+// extensions.
+var picture_extensions = map[string]string{
+	"mjpeg": ".jpg",
+	"png":   ".png",
+}
+
+// ogg_art serialises extracting artwork, so tracks from the same album
+// don't race to write the same file.
+var ogg_art sync.Mutex
+
+func is_ogg(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".ogg" || ext == ".opus"
+}
+
+// picture_stream returns the embedded picture in a file, which ffmpeg
+// exposes as a video stream.
+func picture_stream(metadata Metadata) (int, *Stream) {
+	for i := range metadata.Streams {
+		if metadata.Streams[i].CodecType == "video" {
+			return i, &metadata.Streams[i]
+		}
+	}
+	return -1, nil
+}
+
+// extract_ogg_art saves the METADATA_BLOCK_PICTURE art from an Ogg/Opus
+// source into dir as --art-name, since ffmpeg doesn't carry it across when
+// encoding. Nothing is written if dir already has artwork.
+func extract_ogg_art(runctx context.Context, ctx *cli.Context, filename string, metadata Metadata, dir string) {
+	index, stream := picture_stream(metadata)
+	if stream == nil {
+		return
+	}
+	ext, ok := picture_extensions[stream.CodecName]
+	if !ok {
+		return
+	}
+	ogg_art.Lock()
+	defer ogg_art.Unlock()
+	if has_artwork(dir) {
+		return
+	}
+	output := filepath.Join(dir, art_name(ctx, "cover"+ext))
+	if err := extract_picture(runctx, filename, index, output); err != nil {
+		log.Warn("Failed to extract embedded artwork", "name", path.Base(filename), "error", err)
+		return
+	}
+	log.Info("🖼 Extracted embedded artwork", "name", path.Base(output))
+}
+
+// extract_picture copies the picture stream at index out of filename.
+func extract_picture(runctx context.Context, filename string, index int, output string) error {
+	ffmpeg := exec.CommandContext(runctx, "ffmpeg", "-nostdin", "-hide_banner", "-v", "error", "-y", "-i", filename,
+		"-map", fmt.Sprintf("0:%d", index), "-c", "copy", "-frames:v", "1", "-f", "image2", output)
+	if out, err := ffmpeg.CombinedOutput(); err != nil {
+		os.Remove(output)
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
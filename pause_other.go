@@ -0,0 +1,6 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// watch_pause does nothing, as there's no SIGUSR1 to pause with.
+func watch_pause() {}
@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/charmbracelet/log"
+)
+
+// watch_pause toggles pausing the run on SIGUSR1. Conversions already
+// running are finished, but no more are started until it's resumed.
+func watch_pause() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			if run_pause.toggle() {
+				log.Info("⏸️ Paused, finishing the current files. Send SIGUSR1 again to resume", "pid", os.Getpid())
+			} else {
+				log.Info("▶️ Resumed")
+			}
+		}
+	}()
+}
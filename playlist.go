@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+)
+
+// playlist_formats are the --playlist formats: m3u is latin-1 encoded,
+// for older players, and m3u8 is UTF-8.
+var playlist_formats = []string{"", "m3u", "m3u8"}
+
+var utf8_bom = []byte("\ufeff")
+
+// latin1 encodes s as ISO-8859-1, replacing characters outside it with ?.
+func latin1(s string) []byte {
+	var b []byte
+	for _, r := range s {
+		if r > 0xff {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+// write_playlist writes an extended M3U playlist of the album into
+// outputdir, with paths relative to it. With bom a UTF-8 playlist starts
+// with a byte order mark.
+func write_playlist(format string, bom bool, outputdir string, outputs []conversion_result) error {
+	outputs = slices.Clone(outputs)
+	slices.SortFunc(outputs, compare_tracks)
+
+	var text strings.Builder
+	text.WriteString("#EXTM3U\n")
+	for _, o := range outputs {
+		tags := o.metadata.Format.Tags
+		duration, err := strconv.ParseFloat(o.metadata.Format.Duration, 64)
+		if err != nil {
+			duration = -1
+		}
+		rel, err := filepath.Rel(outputdir, o.output)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&text, "#EXTINF:%d,%s - %s\n%s\n", int(math.Round(duration)), strip_control(join_artists(tags.Artist)), strip_control(tags.Title), filepath.ToSlash(rel))
+	}
+
+	var data bytes.Buffer
+	if format == "m3u" {
+		data.Write(latin1(text.String()))
+	} else {
+		if bom {
+			data.Write(utf8_bom)
+		}
+		data.WriteString(text.String())
+	}
+	name := filesafe(outputs[0].metadata.Format.Tags.Album)
+	if name == "" {
+		name = "playlist"
+	}
+	name = normalize_name(name + "." + format)
+	log.Info("📝 Writing playlist", "file", name)
+	return os.WriteFile(filepath.Join(outputdir, name), data.Bytes(), 0666)
+}
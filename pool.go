@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// limiter bounds the number of workers converting at once. The limit can
+// be changed while the pool is running.
+type limiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+	limit  int
+}
+
+func new_limiter(limit int) *limiter {
+	l := &limiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+func (l *limiter) set_limit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// pause_gate holds workers back from starting another file while the
+// run is paused, without interrupting the conversions already running.
+type pause_gate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+var run_pause = new_pause_gate()
+
+func new_pause_gate() *pause_gate {
+	g := &pause_gate{resumed: make(chan struct{})}
+	close(g.resumed)
+	return g
+}
+
+// wait blocks while the run is paused, or until it's cancelled.
+func (g *pause_gate) wait(runctx context.Context) {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	select {
+	case <-resumed:
+	case <-runctx.Done():
+	}
+}
+
+// toggle pauses or resumes the run, returning whether it's now paused.
+func (g *pause_gate) toggle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		close(g.resumed)
+	} else {
+		g.resumed = make(chan struct{})
+	}
+	g.paused = !g.paused
+	return g.paused
+}
+
+// disk_limiter bounds the conversions reading or writing each device, with
+// --per-disk-jobs, so no single disk is thrashed by the whole pool.
+type disk_limiter struct {
+	mu     sync.Mutex
+	limit  int
+	limits map[uint64]*limiter
+}
+
+func new_disk_limiter(limit int) *disk_limiter {
+	return &disk_limiter{limit: limit, limits: map[uint64]*limiter{}}
+}
+
+// job_devices returns the devices a job reads its source from and writes
+// its output to, in order, so slots are always taken in the same order.
+func job_devices(j job) []uint64 {
+	var devices []uint64
+	for _, filename := range []string{j.input, existing_dir(j.outputdir)} {
+		if dev, ok := file_device(filename); ok && !slices.Contains(devices, dev) {
+			devices = append(devices, dev)
+		}
+	}
+	slices.Sort(devices)
+	return devices
+}
+
+// acquire takes a slot on each of a job's devices, returning the function
+// releasing them.
+func (d *disk_limiter) acquire(j job) func() {
+	var held []*limiter
+	for _, dev := range job_devices(j) {
+		d.mu.Lock()
+		l, ok := d.limits[dev]
+		if !ok {
+			l = new_limiter(d.limit)
+			d.limits[dev] = l
+		}
+		d.mu.Unlock()
+		l.acquire()
+		held = append(held, l)
+	}
+	return func() {
+		for _, l := range held {
+			l.release()
+		}
+	}
+}
+
+// shared_pool bounds the conversions of the whole run with --per-disk-jobs,
+// when albums on different disks are converted at once, so together they
+// stay within --jobs.
+var shared_pool struct {
+	limit *limiter
+	disks *disk_limiter
+}
+
+// set_shared_pool sets up the shared pool for --per-disk-jobs.
+func set_shared_pool(ctx *cli.Context) {
+	n := ctx.Int("per-disk-jobs")
+	if n < 0 {
+		log.Fatal("Per disk jobs can't be negative", "jobs", n)
+	}
+	if n == 0 {
+		return
+	}
+	if ctx.Bool("adaptive-jobs") {
+		log.Fatal("--adaptive-jobs can't be used with --per-disk-jobs")
+	}
+	shared_pool.limit = new_limiter(pool_jobs(ctx))
+	shared_pool.disks = new_disk_limiter(n)
+}
+
+// parallel_albums reports whether albums on different disks are converted
+// at once. Dry runs, estimates and incremental runs total up across the
+// albums, so take them one at a time, as do archives in a shared
+// --output-dir, which are made from the files each album added.
+func parallel_albums(ctx *cli.Context) bool {
+	shared_archives := ctx.Bool("output-archive") && ctx.String("output-dir") != ""
+	return shared_pool.disks != nil && !ctx.Bool("dry-run-json") && !ctx.Bool("estimate") && ctx.String("incremental") == "" && !shared_archives
+}
+
+// albums_in_parallel is set while albums on different disks are being
+// converted at once.
+var albums_in_parallel bool
+
+// disk_groups groups albums by the device of their first file, keeping
+// their order within each device.
+func disk_groups(albums [][]string) [][][]string {
+	var devices []uint64
+	groups := map[uint64][][]string{}
+	for _, album := range albums {
+		dev, _ := file_device(album[0])
+		if _, ok := groups[dev]; !ok {
+			devices = append(devices, dev)
+		}
+		groups[dev] = append(groups[dev], album)
+	}
+	var grouped [][][]string
+	for _, dev := range devices {
+		grouped = append(grouped, groups[dev])
+	}
+	return grouped
+}
+
+// convert_albums converts each album of files, returning the errors of
+// those that failed, or the error that stopped the run. With
+// --per-disk-jobs, the albums on each disk are converted one after another,
+// alongside those on the other disks, so every disk is kept busy.
+func convert_albums(ctx *cli.Context, albums [][]string, convert func([]string) error) ([]error, error) {
+	groups := [][][]string{albums}
+	if parallel_albums(ctx) && len(albums) > 1 {
+		groups = disk_groups(albums)
+	}
+	albums_in_parallel = len(groups) > 1
+	defer func() { albums_in_parallel = false }()
+	var mu sync.Mutex
+	var errs []error
+	var stop error
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group [][]string) {
+			defer wg.Done()
+			for _, album := range group {
+				mu.Lock()
+				stopped := stop != nil
+				mu.Unlock()
+				if stopped {
+					return
+				}
+				err := convert(album)
+				if err == nil {
+					continue
+				}
+				mu.Lock()
+				if stops_run(ctx, err) && stop == nil {
+					stop = err
+				} else {
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+			}
+		}(group)
+	}
+	wg.Wait()
+	return errs, stop
+}
+
+const adaptive_interval = 10 * time.Second
+
+// adaptive_start_jobs is the pool size --adaptive-jobs starts from.
+const adaptive_start_jobs = 2
+
+// max_adaptive_jobs bounds the pool size --adaptive-jobs will try.
+func max_adaptive_jobs() int {
+	if cpu_jobs > 0 {
+		return cpu_jobs
+	}
+	return 2 * runtime.NumCPU()
+}
+
+// adapt_jobs hill climbs the pool size towards the highest throughput. The
+// limiter starts at adaptive_start_jobs, and every interval the bytes
+// converted are compared with the previous interval, continuing to add (or
+// remove) workers while throughput improves and reversing when it drops.
+func adapt_jobs(runctx context.Context, l *limiter, converted *atomic.Int64) {
+	jobs, step := adaptive_start_jobs, 1
+	var last float64
+	ticker := time.NewTicker(adaptive_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-runctx.Done():
+			return
+		case <-ticker.C:
+		}
+		throughput := float64(converted.Swap(0)) / adaptive_interval.Seconds()
+		if throughput < last {
+			step = -step
+		}
+		last = throughput
+		jobs = min(max(jobs+step, 1), max_adaptive_jobs())
+		log.Debug("Adapting jobs", "throughput", int64(throughput), "jobs", jobs)
+		l.set_limit(jobs)
+	}
+}
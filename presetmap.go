@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// preset_rule picks the preset for inputs matching a glob pattern.
+type preset_rule struct {
+	pattern string
+	preset  string
+}
+
+// preset_map is the rules loaded from --preset-map, in file order.
+var preset_map []preset_rule
+
+// load_preset_map reads a file of "pattern = preset" lines. Blank lines and
+// lines starting with # are ignored.
+func load_preset_map(filename string) ([]preset_rule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []preset_rule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, preset, ok := strings.Cut(line, "=")
+		pattern, preset = strings.TrimSpace(pattern), strings.TrimSpace(preset)
+		if !ok || pattern == "" || preset == "" {
+			return nil, fmt.Errorf("%s:%d: expected pattern = preset", filename, n)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, n, err)
+		}
+		rules = append(rules, preset_rule{pattern, preset})
+	}
+	return rules, scanner.Err()
+}
+
+// matches reports whether a rule applies to a job. A pattern is matched
+// against the same number of trailing elements of the input path, so
+// "*.flac" matches the file name and "CD2/*" the files in any CD2 directory.
+func (r preset_rule) matches(j job) bool {
+	path := j.input
+	if j.origin != "" {
+		path = j.origin
+	}
+	elems := strings.Split(filepath.ToSlash(path), "/")
+	n := strings.Count(r.pattern, "/") + 1
+	if n > len(elems) {
+		return false
+	}
+	ok, _ := filepath.Match(r.pattern, strings.Join(elems[len(elems)-n:], "/"))
+	return ok
+}
+
+// job_transcoder returns the transcoder for a job: the preset of the first
+// --preset-map rule it matches, otherwise the default.
+func job_transcoder(ctx *cli.Context, t transcoder, j job) transcoder {
+	for _, r := range preset_map {
+		if r.matches(j) {
+			log.Debug("Preset for file", "file", j.input, "preset", r.preset, "pattern", r.pattern)
+			return preset_transcoder(ctx, r.preset)
+		}
+	}
+	log.Debug("Preset for file", "file", j.input, "preset", t.name)
+	return t
+}
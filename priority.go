@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// priority_prefix is prepended to transcoder commands to lower their CPU
+// and IO priority, from --nice and --ionice.
+var priority_prefix []string
+
+// set_priority builds priority_prefix, warning and running at normal
+// priority where nice or ionice isn't available.
+func set_priority(ctx *cli.Context) {
+	if n := ctx.Int("nice"); n != 0 {
+		if _, err := exec.LookPath("nice"); err == nil {
+			priority_prefix = append(priority_prefix, "nice", "-n", strconv.Itoa(n))
+		} else {
+			log.Warn("nice not found, running at normal CPU priority")
+		}
+	}
+	if ctx.Bool("ionice") {
+		if _, err := exec.LookPath("ionice"); err == nil {
+			// the idle class only gets disk time when nothing else wants it
+			priority_prefix = append(priority_prefix, "ionice", "-c", "3")
+		} else {
+			log.Warn("ionice not found, running at normal IO priority")
+		}
+	}
+}
+
+// cpu_jobs caps the conversions run at once under --cpu-limit, with 0 for
+// no cap.
+var cpu_jobs int
+
+// set_cpu_limit bounds the pool to the share of the CPUs given by
+// --cpu-limit, each ffmpeg limited to a single thread. It's best effort:
+// decoding and the other tools aren't limited, and nothing watches the
+// actual load or temperature.
+func set_cpu_limit(ctx *cli.Context) {
+	percent := ctx.Int("cpu-limit")
+	if percent == 0 {
+		return
+	}
+	if percent < 1 || percent > 100 {
+		log.Fatal("CPU limit must be a percentage from 1 to 100", "limit", percent)
+	}
+	cpu_jobs = max(1, runtime.NumCPU()*percent/100)
+	log.Info("🌡 Limiting CPU", "limit", fmt.Sprintf("%d%%", percent), "jobs", cpu_jobs)
+}
+
+// pool_jobs is the number of files converted or probed at once: --jobs,
+// capped by --cpu-limit.
+func pool_jobs(ctx *cli.Context) int {
+	jobs := max(1, ctx.Int("jobs"))
+	if cpu_jobs > 0 {
+		jobs = min(jobs, cpu_jobs)
+	}
+	return jobs
+}
+
+// priority_command returns the arguments running name at the configured
+// priority.
+func priority_command(name string, args ...string) []string {
+	return append(append(append([]string{}, priority_prefix...), name), args...)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/charmbracelet/log"
+)
+
+// probe_retries is how many times a probe failing with a transient error
+// is retried, from --probe-retries.
+var probe_retries int
+
+const probe_backoff = 250 * time.Millisecond
+
+// transient_probe_errors are the ffprobe errors worth retrying, as they
+// come from the filesystem rather than the file, e.g. a flaky NFS mount.
+var transient_probe_errors = []string{
+	"Input/output error",
+	"Stale file handle",
+	"Resource temporarily unavailable",
+	"Connection timed out",
+}
+
+func is_transient(stderr string) bool {
+	for _, e := range transient_probe_errors {
+		if strings.Contains(stderr, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// run_ffprobe returns the ffprobe JSON for a file. Transient failures are
+// retried up to probe_retries times, doubling the wait each time.
+func run_ffprobe(filename string) ([]byte, error) {
+	backoff := probe_backoff
+	for attempt := 0; ; attempt++ {
+		ffprobe := exec.Command("ffprobe", "-hide_banner", "-i", filename, "-show_format", "-show_streams", "-show_chapters", "-print_format", "json")
+		var stderr bytes.Buffer
+		ffprobe.Stderr = &stderr
+		out, err := ffprobe.Output()
+		if err == nil {
+			return out, nil
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if attempt >= probe_retries || !is_transient(msg) {
+			if msg != "" {
+				return nil, fmt.Errorf("%w: %s", err, last_line(msg))
+			}
+			return nil, err
+		}
+		log.Warn("Probe failed, retrying", "file", filename, "error", last_line(msg), "wait", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func last_line(s string) string {
+	return s[strings.LastIndex(s, "\n")+1:]
+}
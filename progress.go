@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+var progress_modes = []string{"auto", "always", "never"}
+
+// show_progress reports whether to draw the progress bar. In auto mode it's
+// only drawn on a terminal, so it doesn't garble piped output and CI logs.
+func show_progress(ctx *cli.Context) bool {
+	switch ctx.String("progress") {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return term.IsTerminal(int(os.Stderr.Fd()))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// recompress_max_art is the --max-embedded-art of --recompress, unless
+// it's given.
+const recompress_max_art = 1500
+
+// set_recompress sets up --recompress, which reconverts FLACs with the flac
+// preset at compression level 12, dropping oversized artwork. Any other
+// preset is refused, as it wouldn't be a recompression.
+func set_recompress(ctx *cli.Context) {
+	if !ctx.Bool("recompress") {
+		return
+	}
+	if ctx.String("transcoder-command") != "" {
+		log.Fatal("--recompress can't be used with --transcoder-command")
+	}
+	if !ctx.IsSet("transcoder-preset") {
+		ctx.Set("transcoder-preset", "flac")
+	}
+	if ctx.String("transcoder-preset") != "flac" {
+		log.Fatal("--recompress only works with the flac preset", "preset", ctx.String("transcoder-preset"))
+	}
+	if !ctx.IsSet("max-embedded-art") {
+		ctx.Set("max-embedded-art", strconv.Itoa(recompress_max_art))
+	}
+}
+
+// embedded_art_args keeps the artwork embedded in a source when encoding
+// FLAC, copied rather than reencoded as ffmpeg would by default, unless it
+// is larger than --max-embedded-art. ffmpeg's flac muxer always writes 8KB
+// of padding, replacing whatever the source had.
+func embedded_art_args(ctx *cli.Context, t transcoder, j job, metadata Metadata) []string {
+	if t.preset.codec != "flac" || j.gapless != nil || isVideoFile(j.input) {
+		return nil
+	}
+	_, stream := picture_stream(metadata)
+	if stream == nil {
+		return nil
+	}
+	limit := ctx.Int("max-embedded-art")
+	if limit > 0 && max(stream.Width, stream.Height) > limit {
+		log.Info("🖼 Dropped oversized embedded artwork", "name", path.Base(j.input), "size", strconv.Itoa(stream.Width)+"x"+strconv.Itoa(stream.Height))
+		return []string{"-vn"}
+	}
+	return []string{"-c:v", "copy"}
+}
+
+// log_recompressed reports the space a --recompress conversion saved.
+func log_recompressed(name string, size_in, size_out int64) {
+	saved := 0.0
+	if size_in > 0 {
+		saved = float64(size_in-size_out) / float64(size_in) * 100
+	}
+	log.Info("♻️ Recompressed", "name", name, "from", format_size(float64(size_in)), "to", format_size(float64(size_out)), "saved", fmt.Sprintf("%.1f%%", saved))
+}
+
+// log_reclaimed reports the space all the --recompress conversions saved.
+func log_reclaimed(ctx *cli.Context) {
+	if !ctx.Bool("recompress") {
+		return
+	}
+	log.Info("♻️ Reclaimed", "space", format_size(float64(run_summary.bytes_in-run_summary.bytes_out)))
+}
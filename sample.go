@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+)
+
+// valid_sample_start reports whether --sample-start is "middle" or a
+// number of seconds.
+func valid_sample_start(s string) bool {
+	if s == "middle" {
+		return true
+	}
+	start, err := strconv.ParseFloat(s, 64)
+	return err == nil && start >= 0
+}
+
+// sample_window returns the start and length in seconds of the preview clip
+// for a track, and false when --sample-seconds isn't set.
+func sample_window(ctx *cli.Context, metadata Metadata) (float64, float64, bool) {
+	length := ctx.Float64("sample-seconds")
+	if length <= 0 {
+		return 0, 0, false
+	}
+	duration, err := strconv.ParseFloat(metadata.Format.Duration, 64)
+	if err != nil {
+		// unknown duration, so clip from the start
+		return 0, length, true
+	}
+	start := 0.0
+	if s := ctx.String("sample-start"); s == "middle" {
+		start = max(0, (duration-length)/2)
+	} else {
+		start, _ = strconv.ParseFloat(s, 64)
+	}
+	start = min(start, duration)
+	return start, min(length, duration-start), true
+}
+
+// sample_args cuts the output down to the preview clip.
+func sample_args(ctx *cli.Context, metadata Metadata) []string {
+	start, length, ok := sample_window(ctx, metadata)
+	if !ok {
+		return nil
+	}
+	return []string{"-ss", strconv.FormatFloat(start, 'f', 3, 64), "-t", strconv.FormatFloat(length, 'f', 3, 64)}
+}
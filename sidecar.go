@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	log "github.com/charmbracelet/log"
+)
+
+var sidecar_formats = []string{"", "json", "nfo"}
+
+type sidecar_track struct {
+	Position string  `json:"track" xml:"position"`
+	Title    string  `json:"title" xml:"title"`
+	Duration float64 `json:"duration" xml:"-"`
+	Length   string  `json:"-" xml:"duration"`
+	File     string  `json:"file" xml:"-"`
+	SHA256   string  `json:"sha256,omitempty" xml:"-"`
+}
+
+// sidecar describes an album for media server importers. The XML form
+// follows the Kodi album.nfo layout.
+type sidecar struct {
+	XMLName xml.Name        `json:"-" xml:"album"`
+	Artist  string          `json:"artist" xml:"-"`
+	Artists []string        `json:"artists,omitempty" xml:"artist"`
+	Album   string          `json:"album" xml:"title"`
+	Year    string          `json:"year,omitempty" xml:"year,omitempty"`
+	Genre   string          `json:"genre,omitempty" xml:"genre,omitempty"`
+	Preset  string          `json:"preset" xml:"-"`
+	FFmpeg  string          `json:"ffmpeg,omitempty" xml:"-"`
+	Tracks  []sidecar_track `json:"tracks" xml:"track"`
+	// tracks that would clip at the album gain
+	Clipping []album_clip `json:"clipping,omitempty" xml:"-"`
+}
+
+func new_sidecar(preset string, outputs []conversion_result) sidecar {
+	outputs = slices.Clone(outputs)
+	slices.SortFunc(outputs, compare_tracks)
+
+	tags := outputs[0].metadata.Format.Tags
+	s := sidecar{
+		Artist:  tags.AlbumArtist,
+		Artists: split_artists(tags.AlbumArtist),
+		Album:   tags.Album,
+		Year:    tags.Date[:min(4, len(tags.Date))],
+		Genre:   tags.Genre,
+		Preset:  preset,
+	}
+	// the encoder version, for auditing which ffmpeg made an archive
+	s.FFmpeg, _ = ffmpeg_version()
+	for _, o := range outputs {
+		duration, _ := strconv.ParseFloat(o.metadata.Format.Duration, 64)
+		s.Tracks = append(s.Tracks, sidecar_track{
+			Position: o.metadata.Format.Tags.Track,
+			Title:    o.metadata.Format.Tags.Title,
+			Duration: duration,
+			Length:   fmt.Sprintf("%d:%02d", int(duration)/60, int(duration)%60),
+			File:     filepath.Base(o.output),
+			SHA256:   o.sha256,
+		})
+	}
+	s.Clipping = album_clips(outputs)
+	return s
+}
+
+// write_sidecar writes the album description into outputdir, so it's
+// uploaded along with the tracks. With bom the file starts with a UTF-8
+// byte order mark.
+func write_sidecar(format string, bom bool, outputdir string, preset string, outputs []conversion_result) error {
+	s := new_sidecar(preset, outputs)
+	var data []byte
+	var err error
+	var name string
+	if format == "nfo" {
+		name = "album.nfo"
+		data, err = xml.MarshalIndent(s, "", "  ")
+		data = append([]byte(xml.Header), data...)
+	} else {
+		name = "metadata.json"
+		data, err = json.MarshalIndent(s, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	if bom {
+		data = append(slices.Clone(utf8_bom), data...)
+	}
+	log.Info("📝 Writing sidecar", "file", name)
+	return os.WriteFile(filepath.Join(outputdir, name), append(data, '\n'), 0666)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// valid_silence_threshold reports whether --silence-threshold is a level
+// in dB, such as -50dB.
+func valid_silence_threshold(s string) bool {
+	level, err := strconv.ParseFloat(strings.TrimSuffix(s, "dB"), 64)
+	return err == nil && level < 0
+}
+
+// trim_stop_duration is the seconds of silence --trim-silence removes at
+// the end of a track. silenceremove can't tell the end from gaps within the
+// track as it streams, so gaps as long as this are removed too.
+const trim_stop_duration = 2.0
+
+// trim_filters trims silence from the start and end of a track with
+// --trim-silence, in a single pass rather than reversing the audio, which
+// would hold the whole track in memory.
+func trim_filters(ctx *cli.Context) []string {
+	if !ctx.Bool("trim-silence") {
+		return nil
+	}
+	threshold := ctx.String("silence-threshold")
+	return []string{fmt.Sprintf("silenceremove=start_periods=1:start_threshold=%s:start_duration=%g:stop_periods=-1:stop_threshold=%s:stop_duration=%g",
+		threshold, ctx.Float64("silence-duration"), threshold, trim_stop_duration)}
+}
+
+// log_trimmed logs how much silence was trimmed from a track, from the
+// difference between the source and output durations.
+func log_trimmed(filename string, source Metadata, output string) {
+	before, err := strconv.ParseFloat(source.Format.Duration, 64)
+	if err != nil {
+		return
+	}
+	metadata, err := get_metadata(output)
+	if err != nil {
+		return
+	}
+	after, err := strconv.ParseFloat(metadata.Format.Duration, 64)
+	if err != nil {
+		return
+	}
+	if trimmed := before - after; trimmed > 0.01 {
+		log.Info("✂️ Trimmed silence", "file", path.Base(filename), "seconds", fmt.Sprintf("%.2f", trimmed))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// ssh_source is a remote directory of sources from --source ssh://...
+type ssh_source struct {
+	target string // [user@]host
+	port   string
+	dir    string
+}
+
+func parse_ssh_source(s string) (ssh_source, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ssh_source{}, err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" || u.Path == "" {
+		return ssh_source{}, fmt.Errorf("expected ssh://[user@]host[:port]/path: %s", s)
+	}
+	target := u.Hostname()
+	if u.User != nil {
+		target = u.User.Username() + "@" + target
+	}
+	return ssh_source{target, u.Port(), u.Path}, nil
+}
+
+// ssh returns a command running cmd on the remote host.
+func (s ssh_source) ssh(cmd ...string) *exec.Cmd {
+	args := []string{"-o", "BatchMode=yes"}
+	if s.port != "" {
+		args = append(args, "-p", s.port)
+	}
+	args = append(args, s.target, "--", shell_join(cmd))
+	return exec.Command("ssh", args...)
+}
+
+// list returns the remote paths of the zips and audio files under the
+// source directory.
+func (s ssh_source) list() ([]string, error) {
+	find := s.ssh("find", s.dir, "-type", "f")
+	var stderr bytes.Buffer
+	find.Stderr = &stderr
+	out, err := find.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing %s:%s failed: %w: %s", s.target, s.dir, err, strings.TrimSpace(stderr.String()))
+	}
+	var files []string
+	for _, filename := range strings.Split(string(out), "\n") {
+		if path.Ext(filename) == ".zip" || isMediaFile(filename) || isLyricsFile(filename) {
+			files = append(files, filename)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// fetch copies a remote file into dir.
+func (s ssh_source) fetch(filename, dir string) (string, error) {
+	local := filepath.Join(dir, path.Base(filename))
+	f, err := os.Create(local)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cat := s.ssh("cat", filename)
+	cat.Stdout = f
+	var stderr bytes.Buffer
+	cat.Stderr = &stderr
+	if err := cat.Run(); err != nil {
+		return "", fmt.Errorf("fetching %s failed: %w: %s", filename, err, strings.TrimSpace(stderr.String()))
+	}
+	return local, f.Close()
+}
+
+// process_source converts the files from a remote --source. Rather than
+// copying the whole tree up front, each zip, or directory of loose files,
+// is staged into a temporary directory, converted and removed in turn.
+func process_source(ctx *cli.Context, source string) error {
+	s, err := parse_ssh_source(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := s.list()
+	if err != nil {
+		return err
+	}
+	log.Info("🌐 Found remote files", "source", source, "files", len(files))
+
+	// group loose files by directory, keeping zips on their own
+	var groups [][]string
+	dirs := map[string]int{}
+	for _, filename := range files {
+		if path.Ext(filename) == ".zip" {
+			groups = append(groups, []string{filename})
+			continue
+		}
+		dir := path.Dir(filename)
+		if i, ok := dirs[dir]; ok {
+			groups[i] = append(groups[i], filename)
+		} else {
+			dirs[dir] = len(groups)
+			groups = append(groups, []string{filename})
+		}
+	}
+
+	var errs []error
+	for _, group := range groups {
+		err := process_remote_group(ctx, s, group)
+		if err != nil && stops_run(ctx, err) {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func process_remote_group(ctx *cli.Context, s ssh_source, group []string) error {
+	tmpdir, err := os.MkdirTemp("", "audioconvert")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cleanupTmpdir(tmpdir, "staged files")
+	log.Info("📥 Staging", "path", path.Dir(group[0]), "files", len(group))
+	var local []string
+	for _, filename := range group {
+		staged, err := s.fetch(filename, tmpdir)
+		if err != nil {
+			return err
+		}
+		if !isLyricsFile(staged) {
+			local = append(local, staged)
+		}
+	}
+	if path.Ext(group[0]) == ".zip" {
+		return process_zip(ctx, local[0])
+	}
+	return process_single_files(ctx, local)
+}
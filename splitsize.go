@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// max_output_size is the largest output in bytes, from --max-output-size.
+// Longer tracks are split into parts to fit.
+var max_output_size uint64
+
+// lossless_headroom is how far below --max-output-size lossless parts are
+// aimed, as their size depends on how well the audio compresses.
+const lossless_headroom = 0.9
+
+// size_part is a piece of a track split by --max-output-size.
+type size_part struct {
+	number, count int
+	start, end    float64 // seconds, with end 0 for the end of the track
+}
+
+// split_large_jobs splits the jobs whose estimated output is larger than
+// --max-output-size into equal length parts. Cue sheet tracks and accurate
+// gapless albums are already cut from their source, so aren't split again.
+func split_large_jobs(ctx *cli.Context, jobs []job) []job {
+	if max_output_size == 0 || ctx.String("gapless") == "accurate" {
+		return jobs
+	}
+	var split []job
+	for i, metadata := range probe_all(jobs) {
+		j := jobs[i]
+		t := job_transcoder(ctx, get_transcoder(ctx), j)
+		duration, err := strconv.ParseFloat(metadata.Format.Duration, 64)
+		if err != nil || j.cue != nil || t.command != "" {
+			split = append(split, j)
+			continue
+		}
+		limit := float64(max_output_size)
+		lossless := t.name == "remux" || is_lossless(t.preset.codec)
+		if lossless {
+			limit *= lossless_headroom
+		}
+		projected := output_bitrate(ctx, t, j, metadata) * duration / 8
+		count := int(math.Ceil(projected / limit))
+		if count <= 1 {
+			split = append(split, j)
+			continue
+		}
+		log.Info("✂️ Splitting output", "name", path.Base(j.input), "estimated", format_size(projected), "parts", count)
+		if lossless {
+			log.Warn("Lossless sizes can only be estimated, so parts may slightly exceed --max-output-size", "name", path.Base(j.input))
+		}
+		length := duration / float64(count)
+		for n := 1; n <= count; n++ {
+			part := &size_part{number: n, count: count, start: float64(n-1) * length}
+			if n < count {
+				part.end = float64(n) * length
+			}
+			j.part = part
+			split = append(split, j)
+		}
+	}
+	return split
+}
+
+// apply retitles the metadata of a track for the part, and sets its
+// duration. The title is also added, so it's written over the file's own.
+func (part *size_part) apply(metadata *Metadata) {
+	if duration, err := strconv.ParseFloat(metadata.Format.Duration, 64); err == nil {
+		end := part.end
+		if end == 0 {
+			end = duration
+		}
+		metadata.Format.Duration = strconv.FormatFloat(end-part.start, 'f', 3, 64)
+	}
+	title := fmt.Sprintf("%s (part %d of %d)", metadata.Format.Tags.Title, part.number, part.count)
+	metadata.Format.Tags.Title, metadata.Added.Title = title, title
+}
+
+// input_args seek the input to the part.
+func (part *size_part) input_args() []string {
+	args := []string{"-ss", strconv.FormatFloat(part.start, 'f', 3, 64)}
+	if part.end > 0 {
+		args = append(args, "-to", strconv.FormatFloat(part.end, 'f', 3, 64))
+	}
+	return args
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// stream_muxers maps output extensions to a muxer that can be written to a
+// pipe.
+var stream_muxers = map[string]string{
+	"opus": "opus",
+	"ogg":  "ogg",
+	"oga":  "ogg",
+	"mka":  "matroska",
+	"m4a":  "adts",
+	"mp3":  "mp3",
+	"flac": "flac",
+	"wav":  "wav",
+}
+
+// stream_event marks the start of a track within the stream.
+type stream_event struct {
+	Offset float64 `json:"offset"`
+	Artist string  `json:"artist"`
+	Album  string  `json:"album"`
+	Title  string  `json:"title"`
+	File   string  `json:"file"`
+}
+
+// stream_files encodes the files in order as one continuous stream, written
+// to --stream ("-" for stdout). The tracks are joined with the concat filter
+// ahead of a single encoder, so there's no discontinuity between them.
+func stream_files(ctx *cli.Context, files []string) error {
+	t := get_transcoder(ctx)
+	if t.command != "" || t.name == "remux" {
+		log.Fatal("Streaming needs a transcoder preset")
+	}
+	muxer, ok := stream_muxers[t.extension]
+	if !ok || t.preset.codec == "alac" {
+		log.Fatal("Preset can't be streamed", "preset", t.name)
+	}
+
+	var events []stream_event
+	var offset float64
+	// ffmpeg's stderr is passed through, so it's quiet unless asked for
+	loglevel := "error"
+	if ctx.IsSet("ffmpeg-loglevel") {
+		loglevel = ctx.String("ffmpeg-loglevel")
+	}
+	args := []string{"-nostdin", "-hide_banner", "-v", loglevel}
+	for _, filename := range files {
+		metadata, err := get_metadata(filename)
+		if err != nil {
+			return err
+		}
+		tags := metadata.Format.Tags
+		events = append(events, stream_event{offset, tags.Artist, tags.Album, tags.Title, filename})
+		duration, _ := strconv.ParseFloat(metadata.Format.Duration, 64)
+		offset += duration
+		args = append(args, "-i", filename)
+	}
+	var concat string
+	for i := range files {
+		concat += fmt.Sprintf("[%d:a:0]", i)
+	}
+	concat += fmt.Sprintf("concat=n=%d:v=0:a=1[out]", len(files))
+	args = append(args, "-filter_complex", concat, "-map", "[out]", "-c:a", t.preset.codec)
+	args = append(args, t.preset.args...)
+	if t.preset.codec == "libopus" {
+		opus_args, _ := opus_args(ctx, nil)
+		args = append(args, opus_args...)
+	}
+	args = append(args, "-f", muxer, "pipe:1")
+
+	if path := ctx.String("stream-events"); path != "" {
+		if err := write_stream_events(path, events); err != nil {
+			return err
+		}
+	}
+
+	out := os.Stdout
+	if dest := ctx.String("stream"); dest != "-" {
+		// a named pipe blocks here until the reader opens it
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	log.Info("📡 Streaming", "count", len(files), "preset", t.name)
+	ffmpeg := exec.CommandContext(ctx.Context, "ffmpeg", args...)
+	hashed := new_hashing_writer(out)
+	ffmpeg.Stdout = hashed
+	ffmpeg.Stderr = os.Stderr
+	log.Debug("Running ffmpeg", "args", args)
+	if err := ffmpeg.Run(); err != nil {
+		return err
+	}
+	log.Info("📡 Streamed", "sha256", hashed.sum())
+	return nil
+}
+
+// write_stream_events writes a JSON line per track with its start offset in
+// the stream, for streamers to update the now playing title.
+func write_stream_events(path string, events []stream_event) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
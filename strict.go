@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// With --strict the following checks fail the file instead of logging a
+// warning and carrying on:
+//
+//   - missing tags: the source has no title, track, artist or album
+//   - collision: another source in the run converts to the same output path
+//   - zero-byte output: the converted file is empty
+//   - duration mismatch: the output is more than duration_tolerance seconds
+//     longer or shorter than the source, or the --sample-seconds clip
+//
+// There is no spectrum analysis, so a suspicious (eg. upsampled lossy)
+// source isn't detected in either mode.
+const duration_tolerance = 1.0
+
+// claimed_outputs maps each output path to the source converting to it.
+var claimed_outputs sync.Map
+
+// strict_warning logs a warning about a file, or returns it as an error
+// with --strict.
+func strict_warning(ctx *cli.Context, filename, msg string, keyvals ...interface{}) error {
+	if ctx.Bool("strict") {
+		var details []string
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			details = append(details, fmt.Sprintf("%v=%v", keyvals[i], keyvals[i+1]))
+		}
+		if len(details) > 0 {
+			msg += " (" + strings.Join(details, " ") + ")"
+		}
+		return errors.New(msg)
+	}
+	log.Warn(msg, append([]interface{}{"name", path.Base(filename)}, keyvals...)...)
+	return nil
+}
+
+// check_tags warns about sources missing the tags used for naming outputs.
+func check_tags(ctx *cli.Context, filename string, tags Tags) error {
+	var missing []string
+	for _, tag := range []struct{ name, value string }{
+		{"title", tags.Title},
+		{"track", tags.Track},
+		{"artist", tags.Artist},
+		{"album", tags.Album},
+	} {
+		if tag.value == "" {
+			missing = append(missing, tag.name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return strict_warning(ctx, filename, "Missing tags", "tags", missing)
+}
+
+// check_collision warns when two sources convert to the same output.
+func check_collision(ctx *cli.Context, filename, output string) error {
+	other, loaded := claimed_outputs.LoadOrStore(output, filename)
+	if !loaded || other == filename {
+		return nil
+	}
+	return strict_warning(ctx, filename, "Output collides with another file", "output", path.Base(output), "other", path.Base(other.(string)))
+}
+
+// check_output warns about empty outputs, or ones whose duration differs
+// from the source.
+func check_output(ctx *cli.Context, filename, output string, size int64, source Metadata) error {
+	if size == 0 {
+		return strict_warning(ctx, filename, "Output is empty", "output", path.Base(output))
+	}
+	want, err := strconv.ParseFloat(source.Format.Duration, 64)
+	if err != nil {
+		return nil
+	}
+	if _, length, ok := sample_window(ctx, source); ok {
+		want = length
+	}
+	if ctx.Bool("trim-silence") {
+		// trimmed outputs are expected to be shorter
+		return nil
+	}
+	metadata, err := get_metadata(output)
+	if err != nil {
+		return strict_warning(ctx, filename, "Could not probe output", "error", err)
+	}
+	got, err := strconv.ParseFloat(metadata.Format.Duration, 64)
+	if err != nil || math.Abs(got-want) <= duration_tolerance {
+		return nil
+	}
+	return strict_warning(ctx, filename, "Output duration doesn't match the source", "source", want, "output", got)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+)
+
+// path_patterns are the built in --tag-from-path templates.
+var path_patterns = map[string]string{
+	"album-dirs":       "{artist}/{album}/{track} - {title}",
+	"dated-album-dirs": "{artist}/{date} - {album}/{track} - {title}",
+	"flat":             "{artist} - {album} - {track} - {title}",
+}
+
+// tag_path_pattern parses tags from file paths, from --tag-from-path.
+var tag_path_pattern *regexp.Regexp
+
+var placeholder_re = regexp.MustCompile(`\{(\w+)\}`)
+
+// compile_path_pattern compiles a built in pattern name, a template of
+// {field} placeholders, or a regexp with named groups, each named after a
+// tag such as artist, album_artist, album, date, disc, track or title. The
+// pattern is matched against the end of the path, without its extension.
+func compile_path_pattern(pattern string) (*regexp.Regexp, error) {
+	if template, ok := path_patterns[pattern]; ok {
+		pattern = template
+	}
+	expr := pattern
+	if !strings.Contains(pattern, "(?P<") {
+		expr = ""
+		last := 0
+		for _, m := range placeholder_re.FindAllStringSubmatchIndex(pattern, -1) {
+			name := pattern[m[2]:m[3]]
+			group := `[^/]+?`
+			switch name {
+			case "track", "disc":
+				group = `\d+`
+			case "date":
+				group = `\d{4}`
+			}
+			expr += regexp.QuoteMeta(pattern[last:m[0]]) + "(?P<" + name + ">" + group + ")"
+			last = m[1]
+		}
+		expr += regexp.QuoteMeta(pattern[last:])
+	}
+	re, err := regexp.Compile("(?:^|/)" + expr + "$")
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Tags{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[tag_key(t.Field(i))] = true
+	}
+	for _, name := range re.SubexpNames()[1:] {
+		if !fields[name] {
+			return nil, fmt.Errorf("unknown tag %q in pattern %s", name, pattern)
+		}
+	}
+	if re.NumSubexp() == 0 {
+		return nil, fmt.Errorf("no tags in pattern %s", pattern)
+	}
+	return re, nil
+}
+
+// path_tags fills tags missing from a file from its path. Inside zips, only
+// the path within the archive is available.
+func path_tags(filename string, tags Tags) Tags {
+	if tag_path_pattern == nil {
+		return tags
+	}
+	name := filepath.ToSlash(strings.TrimSuffix(filename, filepath.Ext(filename)))
+	m := tag_path_pattern.FindStringSubmatch(name)
+	if m == nil {
+		log.Debug("Path doesn't match --tag-from-path", "path", filename)
+		return tags
+	}
+	var fallback Tags
+	v := reflect.ValueOf(&fallback).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if j := tag_path_pattern.SubexpIndex(tag_key(v.Type().Field(i))); j > 0 {
+			v.Field(i).SetString(strings.TrimSpace(m[j]))
+		}
+	}
+	return merge_tags(tags, fallback)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+// various_artists are the album artists compilations are credited to.
+var various_artists = []string{"various artists", "various", "va"}
+
+// picture_extensions_embedded are the outputs ffmpeg carries a track's
+// embedded picture into. The others, like opus, lose it when encoding.
+var picture_extensions_embedded = []string{"mp3", "m4a", "m4b", "mp4", "flac", "mka"}
+
+// is_compilation reports whether an album is credited to various artists,
+// where tracks often have their own artwork.
+func is_compilation(tags Tags) bool {
+	artist := strings.ToLower(strings.TrimSpace(tags.AlbumArtist))
+	return slices.Contains(various_artists, artist) || artist == strings.ToLower(va_name)
+}
+
+// save_track_art keeps a track's own embedded artwork, with --per-track-art
+// or for compilations. Formats that can't hold it get an image named after
+// the track alongside, and in a --per-track-dir it replaces the album
+// cover. Tracks without artwork are left with the album's.
+func save_track_art(runctx context.Context, ctx *cli.Context, filename string, metadata Metadata, output string) {
+	if !ctx.Bool("per-track-art") && !is_compilation(metadata.Format.Tags) {
+		return
+	}
+	index, stream := picture_stream(metadata)
+	if stream == nil || isVideoFile(filename) {
+		return
+	}
+	ext, ok := picture_extensions[stream.CodecName]
+	if !ok {
+		return
+	}
+	extension := strings.TrimPrefix(filepath.Ext(output), ".")
+	var image string
+	if ctx.Bool("per-track-dir") {
+		image = filepath.Join(filepath.Dir(output), art_name(ctx, "cover"+ext))
+	} else if !slices.Contains(picture_extensions_embedded, extension) {
+		image = strings.TrimSuffix(output, filepath.Ext(output)) + ext
+	} else {
+		return
+	}
+	if err := extract_picture(runctx, filename, index, image); err != nil {
+		log.Warn("Failed to extract track artwork", "name", path.Base(filename), "error", err)
+		return
+	}
+	log.Info("🖼 Extracted track artwork", "name", path.Base(image))
+}
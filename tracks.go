@@ -0,0 +1,79 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// vinyl_track matches track numbers with a side, such as "A3".
+var vinyl_track = regexp.MustCompile(`^([A-Za-z])(\d+)$`)
+
+// parse_track parses a track tag such as "3", "03", "3/12" or the vinyl
+// "A3", returning the number on its side for the last.
+func parse_track(s string) (num int, ok bool) {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "/")
+	s = strings.TrimSpace(s)
+	if m := vinyl_track.FindStringSubmatch(s); m != nil {
+		s = m[2]
+	}
+	num, err := strconv.Atoi(s)
+	return num, err == nil && num >= 0
+}
+
+// track_side returns the vinyl side of a track tag, upper cased, or "".
+func track_side(s string) string {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "/")
+	if m := vinyl_track.FindStringSubmatch(strings.TrimSpace(s)); m != nil {
+		return strings.ToUpper(m[1])
+	}
+	return ""
+}
+
+// compare_tracks orders outputs by disc, then side and track number, so
+// playlists follow the album whatever the outputs are named. Tracks without
+// numbers come after those with, and they and ties such as the parts of a
+// split track are ordered by path.
+func compare_tracks(a, b conversion_result) int {
+	ta, tb := a.metadata.Format.Tags, b.metadata.Format.Tags
+	da, _ := parse_disc(ta.Disc)
+	db, _ := parse_disc(tb.Disc)
+	if c := cmp.Compare(da, db); c != 0 {
+		return c
+	}
+	na, oka := parse_track(ta.Track)
+	nb, okb := parse_track(tb.Track)
+	if oka != okb {
+		if oka {
+			return -1
+		}
+		return 1
+	}
+	if oka {
+		if c := cmp.Compare(track_side(ta.Track), track_side(tb.Track)); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(na, nb); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a.output, b.output)
+}
+
+// track_prefix returns the zero padded track number outputs are named with,
+// keeping any vinyl side, e.g. "03" or "A03". Tags that can't be parsed are
+// used as they are.
+func track_prefix(s string) string {
+	num, ok := parse_track(s)
+	if !ok {
+		return filesafe(strings.TrimSpace(s))
+	}
+	prefix := fmt.Sprintf("%02d", num)
+	if r := []rune(strings.TrimSpace(s)); len(r) > 0 && unicode.IsLetter(r[0]) {
+		prefix = string(unicode.ToUpper(r[0])) + prefix
+	}
+	return prefix
+}
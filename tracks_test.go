@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseTrack(t *testing.T) {
+	tests := []struct {
+		in   string
+		num  int
+		ok   bool
+		side string
+	}{
+		{"3", 3, true, ""},
+		{"03", 3, true, ""},
+		{"3/12", 3, true, ""},
+		{" 3 / 12 ", 3, true, ""},
+		{"A3", 3, true, "A"},
+		{"b12/20", 12, true, "B"},
+		{"", 0, false, ""},
+		{"three", 0, false, ""},
+		{"-1", -1, false, ""},
+		{"AB3", 0, false, ""},
+	}
+	for _, tt := range tests {
+		num, ok := parse_track(tt.in)
+		if ok != tt.ok || (ok && num != tt.num) {
+			t.Errorf("parse_track(%q) = %d, %v, want %d, %v", tt.in, num, ok, tt.num, tt.ok)
+		}
+		if side := track_side(tt.in); side != tt.side {
+			t.Errorf("track_side(%q) = %q, want %q", tt.in, side, tt.side)
+		}
+	}
+}
+
+func TestTrackPrefix(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"3", "03"},
+		{"03", "03"},
+		{"3/12", "03"},
+		{"112", "112"},
+		{"A3", "A03"},
+		{"a3", "A03"},
+		{"bonus", "bonus"},
+		{" x/y ", "x_y"},
+	}
+	for _, tt := range tests {
+		if got := track_prefix(tt.in); got != tt.want {
+			t.Errorf("track_prefix(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCompareTracks(t *testing.T) {
+	result := func(output, disc, track string) conversion_result {
+		var r conversion_result
+		r.output = output
+		r.metadata.Format.Tags.Disc = disc
+		r.metadata.Format.Tags.Track = track
+		return r
+	}
+	outputs := []conversion_result{
+		result("a.opus", "2/2", "1"),
+		result("b.opus", "1/2", "10"),
+		result("c.opus", "1/2", "2/12"),
+		result("d.opus", "", "B1"),
+		result("e.opus", "", "A2"),
+		result("z.opus", "1/2", "junk"),
+		result("y.opus", "1/2", ""),
+	}
+	slices.SortFunc(outputs, compare_tracks)
+	var got []string
+	for _, r := range outputs {
+		got = append(got, r.output)
+	}
+	want := []string{"e.opus", "d.opus", "c.opus", "b.opus", "y.opus", "z.opus", "a.opus"}
+	if !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+)
+
+// unzip extracts each entry of the archive independently, so one corrupt
+// entry doesn't lose the rest of the album. It returns the number of
+// entries that failed.
+func unzip(filename string, dir string) (int, error) {
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer archive.Close()
+
+	failed := 0
+	for _, entry := range archive.File {
+		if err := unzip_entry(entry, dir); err != nil {
+			log.Error("Failed to extract", "entry", entry.Name, "error", err)
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+func unzip_entry(entry *zip.File, dir string) error {
+	dest := filepath.Join(dir, entry.Name)
+	if !strings.HasPrefix(dest, filepath.Clean(dir)+string(os.PathSeparator)) {
+		return fmt.Errorf("entry outside the archive directory")
+	}
+	if entry.FileInfo().IsDir() {
+		return os.MkdirAll(dest, 0777)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	log.Debug("Extracting", "entry", entry.Name)
+
+	in, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	// the checksum is verified when the entry is read to the end
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+
+	log "github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+const upload_workers = 2
+
+// uploader rsyncs each output as soon as it's converted, overlapping the
+// uploads with the conversion of the rest of the album.
+type uploader struct {
+	queue chan string
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	errs  []error
+}
+
+func start_uploader(ctx *cli.Context, outputdir string, dest string) *uploader {
+	u := &uploader{queue: make(chan string, 64)}
+	u.wg.Add(upload_workers)
+	for i := 0; i < upload_workers; i++ {
+		go func() {
+			defer u.wg.Done()
+			for filename := range u.queue {
+				rel, _ := filepath.Rel(outputdir, filepath.Dir(filename))
+				log.Debug("📤 Uploading", "name", filepath.Base(filename))
+				if err := rsync(ctx, filename, filepath.Join(dest, rel)+"/"); err != nil {
+					u.mu.Lock()
+					u.errs = append(u.errs, err)
+					u.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return u
+}
+
+func (u *uploader) add(filename string) {
+	u.queue <- filename
+}
+
+// wait waits for the queued uploads to finish.
+func (u *uploader) wait() error {
+	close(u.queue)
+	u.wg.Wait()
+	return errors.Join(u.errs...)
+}
+
+// rsync_all rsyncs src to each destination concurrently. A failure to one
+// destination doesn't stop the others.
+func rsync_all(ctx *cli.Context, src string, dests []string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(dests))
+	for i, dest := range dests {
+		wg.Add(1)
+		go func(i int, dest string) {
+			defer wg.Done()
+			log.Info("📤 Uploading", "destination", dest)
+			errs[i] = rsync(ctx, src, dest+"/")
+		}(i, dest)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
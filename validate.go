@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/charmbracelet/log"
+)
+
+var input_var = regexp.MustCompile(`\$(input\b|\{input\})`)
+var output_var = regexp.MustCompile(`\$(output\b|\{output\})`)
+
+// validate_command checks a custom transcoder command references its input
+// and output, and that it can be parsed: by bash with --shell, otherwise
+// into arguments.
+func validate_command(command string, shell bool) error {
+	if !input_var.MatchString(command) {
+		return fmt.Errorf("transcoder command doesn't reference $input")
+	}
+	if !output_var.MatchString(command) {
+		return fmt.Errorf("transcoder command doesn't reference $output")
+	}
+	if !shell {
+		if _, err := split_args(command); err != nil {
+			return fmt.Errorf("transcoder command syntax: %w", err)
+		}
+		return nil
+	}
+	bash := exec.Command("bash", "-n", "-c", command)
+	if out, err := bash.CombinedOutput(); err != nil {
+		return fmt.Errorf("transcoder command syntax: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// trial_command runs the command on a second of generated silence, checking
+// it produces some output.
+func trial_command(t transcoder) error {
+	tmpdir, err := os.MkdirTemp("", "audioconvert")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	input := filepath.Join(tmpdir, "silence.flac")
+	ffmpeg := exec.Command("ffmpeg", "-nostdin", "-hide_banner", "-v", "error",
+		"-f", "lavfi", "-i", "anullsrc=r=44100:cl=stereo", "-t", "1", input)
+	if out, err := ffmpeg.CombinedOutput(); err != nil {
+		return fmt.Errorf("generating sample: %w: %s", err, out)
+	}
+
+	output := filepath.Join(tmpdir, "output."+t.extension)
+	log.Info("🧪 Trying transcoder command")
+	args := custom_command(t).resolve(track_vars(input, output, Metadata{}))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = track_env(input, output, Metadata{})
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("transcoder command failed: %w: %s", err, out)
+	}
+	if stat, err := os.Stat(output); err != nil || stat.Size() == 0 {
+		return fmt.Errorf("transcoder command produced no output")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// decode_errors decodes a file, returning an error if ffmpeg reports any
+// problems even when it manages to finish.
+func decode_errors(runctx context.Context, filename string) error {
+	ffmpeg := exec.CommandContext(runctx, "ffmpeg", "-nostdin", "-hide_banner", "-v", "error", "-i", filename, "-f", "null", "-")
+	var stderr bytes.Buffer
+	ffmpeg.Stderr = &stderr
+	err := ffmpeg.Run()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%s", msg)
+	}
+	return err
+}
+
+// verify_output checks an output decodes cleanly, as an encoder failing
+// late can leave a file that probes fine but is truncated or corrupt.
+func verify_output(runctx context.Context, filename string) error {
+	if err := decode_errors(runctx, filename); err != nil {
+		return fmt.Errorf("output failed verification: %w", err)
+	}
+	return nil
+}
+
+// verify_input checks a source decodes cleanly before it's converted. FLACs
+// are tested with flac -t where available, which also checks the MD5 of the
+// decoded audio.
+func verify_input(runctx context.Context, filename string) error {
+	var err error
+	if _, lookErr := exec.LookPath("flac"); lookErr == nil && strings.EqualFold(filepath.Ext(filename), ".flac") {
+		flac := exec.CommandContext(runctx, "flac", "-t", "-s", filename)
+		var out []byte
+		if out, err = flac.CombinedOutput(); err != nil {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+	} else {
+		err = decode_errors(runctx, filename)
+	}
+	if err != nil {
+		return fmt.Errorf("input failed verification: %w", err)
+	}
+	return nil
+}
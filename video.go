@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// video_extensions are containers whose audio track is converted, such as
+// concert recordings.
+var video_extensions = []string{".mkv", ".mp4", ".m4v", ".mov", ".webm", ".avi"}
+
+func isVideoFile(filename string) bool {
+	return slices.Contains(video_extensions, strings.ToLower(filepath.Ext(filename)))
+}
+
+// isMediaFile reports whether a file can be converted.
+func isMediaFile(filename string) bool {
+	return isAudioFile(filename) || isVideoFile(filename)
+}
+
+// best_audio_stream returns the index of the audio stream to convert: the
+// one with the most channels, then the highest sample rate, as ffmpeg
+// picks by default.
+func best_audio_stream(metadata Metadata) int {
+	best, best_rate := -1, 0
+	for i, stream := range metadata.Streams {
+		if stream.CodecType != "audio" {
+			continue
+		}
+		rate, _ := strconv.Atoi(stream.SampleRate)
+		if best < 0 || stream.Channels > metadata.Streams[best].Channels ||
+			(stream.Channels == metadata.Streams[best].Channels && rate > best_rate) {
+			best, best_rate = i, rate
+		}
+	}
+	return best
+}
+
+// video_title names tracks from videos without a title after the file.
+func video_title(filename string, metadata *Metadata) {
+	if metadata.Format.Tags.Title == "" {
+		title := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+		metadata.Format.Tags.Title = title
+		metadata.Added.Title = title
+	}
+}